@@ -0,0 +1,393 @@
+// betsctl queries and maintains bets store files copied off a server,
+// without the server running. See the README for the available commands.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/spf13/pflag"
+)
+
+const (
+	exitOk      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+var commands = map[string]func(args []string) int{
+	"count":    countCommand,
+	"winners":  winnersCommand,
+	"validate": validateCommand,
+	"dedupe":   dedupeCommand,
+	"convert":  convertCommand,
+	"merge":    mergeCommand,
+}
+
+var usages = map[string]string{
+	"count":    "count [--cancellations FILE] FILE...",
+	"winners":  "winners [--number N] [--cancellations FILE] FILE...",
+	"validate": "validate FILE...",
+	"dedupe":   "dedupe [--cancellations FILE] [-o OUTPUT] FILE",
+	"convert":  "convert [--to FORMAT] [-o OUTPUT] FILE",
+	"merge":    "merge [--renumber] [--cancellations FILE] [-o OUTPUT] FILE...",
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	os.Exit(command(os.Args[2:]))
+}
+
+func printUsage() {
+	names := make([]string, 0, len(usages))
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: betsctl COMMAND [OPTIONS]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  betsctl %v\n", usages[name])
+	}
+	fmt.Fprintln(os.Stderr, "\nfiles ending in .jsonl or .json are read as JSONL, any other file as CSV")
+}
+
+// parseFlags Parses the options of a command and returns its files, which
+// must be at least minFiles and at most maxFiles, 0 meaning no limit. ok is
+// false if the command must exit with code
+func parseFlags(fs *pflag.FlagSet, name string, args []string, minFiles int, maxFiles int) (files []string, code int, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return nil, exitOk, false
+		}
+		return nil, exitUsage, false
+	}
+	files = fs.Args()
+	if len(files) < minFiles || (maxFiles > 0 && len(files) > maxFiles) {
+		fmt.Fprintf(os.Stderr, "usage: betsctl %v\n", usages[name])
+		return nil, exitUsage, false
+	}
+	return files, exitOk, true
+}
+
+// forEachBet Calls fn for every bet of the files, in order, skipping the
+// cancelled ones. A cancellation only matches a bet of its own agency, as
+// tickets of stores copied off different servers may collide. A malformed
+// record is an error
+func forEachBet(files []string, cancellations map[int64]bets.Cancellation, fn func(*bets.Bet) error) error {
+	for _, path := range files {
+		err := bets.ScanFile(path, bets.FormatOf(path), func(record bets.Record) error {
+			if record.Err != nil {
+				return fmt.Errorf("%v:%v: %v", path, record.Line, record.Err)
+			}
+			if cancellation, ok := cancellations[record.Bet.Ticket]; ok && cancellation.Agency == record.Bet.Agency {
+				return nil
+			}
+			return fn(record.Bet)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadCancellations(path string) (map[int64]bets.Cancellation, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return bets.LoadCancellationsFrom(path)
+}
+
+func countCommand(args []string) int {
+	fs := pflag.NewFlagSet("count", pflag.ContinueOnError)
+	cancellationsPath := fs.String("cancellations", "", "cancelled bets file, its bets are not counted")
+	files, code, ok := parseFlags(fs, "count", args, 1, 0)
+	if !ok {
+		return code
+	}
+	cancellations, err := loadCancellations(*cancellationsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading cancellations: %v\n", err)
+		return exitFailure
+	}
+
+	byAgency := make(map[int]int64)
+	total := int64(0)
+	err = forEachBet(files, cancellations, func(bet *bets.Bet) error {
+		byAgency[bet.Agency]++
+		total++
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error counting bets: %v\n", err)
+		return exitFailure
+	}
+
+	agencies := make([]int, 0, len(byAgency))
+	for agency := range byAgency {
+		agencies = append(agencies, agency)
+	}
+	sort.Ints(agencies)
+	fmt.Println("agency,bets")
+	for _, agency := range agencies {
+		fmt.Printf("%v,%v\n", agency, byAgency[agency])
+	}
+	fmt.Printf("total,%v\n", total)
+	return exitOk
+}
+
+func winnersCommand(args []string) int {
+	fs := pflag.NewFlagSet("winners", pflag.ContinueOnError)
+	number := fs.Int("number", bets.LOTTERY_WINNER_NUMBER, "winning number")
+	cancellationsPath := fs.String("cancellations", "", "cancelled bets file, its bets can't win")
+	files, code, ok := parseFlags(fs, "winners", args, 1, 0)
+	if !ok {
+		return code
+	}
+	cancellations, err := loadCancellations(*cancellationsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading cancellations: %v\n", err)
+		return exitFailure
+	}
+
+	fmt.Println("ticket,agency,first_name,last_name,document")
+	err = forEachBet(files, cancellations, func(bet *bets.Bet) error {
+		if bet.Number == *number {
+			fmt.Printf("%v,%v,%v,%v,%v\n", bet.Ticket, bet.Agency, bet.FirstName, bet.LastName, bet.Document)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading bets: %v\n", err)
+		return exitFailure
+	}
+	return exitOk
+}
+
+// validateCommand Lists every record that can't be parsed or that repeats
+// a ticket of the same file
+func validateCommand(args []string) int {
+	fs := pflag.NewFlagSet("validate", pflag.ContinueOnError)
+	files, code, ok := parseFlags(fs, "validate", args, 1, 0)
+	if !ok {
+		return code
+	}
+
+	problems := 0
+	for _, path := range files {
+		seen := make(map[int64]int)
+		records := 0
+		err := bets.ScanFile(path, bets.FormatOf(path), func(record bets.Record) error {
+			records++
+			if record.Err != nil {
+				fmt.Printf("%v:%v: %v\n", path, record.Line, record.Err)
+				problems++
+				return nil
+			}
+			if line, ok := seen[record.Bet.Ticket]; ok {
+				fmt.Printf("%v:%v: ticket %v already used at line %v\n", path, record.Line, record.Bet.Ticket, line)
+				problems++
+				return nil
+			}
+			seen[record.Bet.Ticket] = record.Line
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %v: %v\n", path, err)
+			return exitFailure
+		}
+		fmt.Fprintf(os.Stderr, "%v: %v records\n", path, records)
+	}
+
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "%v invalid records\n", problems)
+		return exitFailure
+	}
+	return exitOk
+}
+
+// betKey Identifies a bet by everything but its ticket
+func betKey(bet *bets.Bet) string {
+	return strings.Join([]string{
+		fmt.Sprint(bet.Agency),
+		bet.FirstName,
+		bet.LastName,
+		bet.Document,
+		bet.BirthDate.Format("2006-01-02"),
+		fmt.Sprint(bet.Number),
+	}, "\x00")
+}
+
+// dedupeCommand Writes the bets of a store keeping only the first of the
+// bets that are equal in everything but their ticket. Cancelled bets are
+// left out, so a cancelled bet doesn't hide a later equal one
+func dedupeCommand(args []string) int {
+	fs := pflag.NewFlagSet("dedupe", pflag.ContinueOnError)
+	cancellationsPath := fs.String("cancellations", "", "cancelled bets file, its bets are left out")
+	output := fs.StringP("output", "o", "", "output file, standard output if empty")
+	files, code, ok := parseFlags(fs, "dedupe", args, 1, 1)
+	if !ok {
+		return code
+	}
+	cancellations, err := loadCancellations(*cancellationsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading cancellations: %v\n", err)
+		return exitFailure
+	}
+
+	seen := make(map[string]bool)
+	written, removed := 0, 0
+	err = writeBets(*output, outputFormat(*output, files[0]), func(writer *bets.Writer) error {
+		return forEachBet(files, cancellations, func(bet *bets.Bet) error {
+			key := betKey(bet)
+			if seen[key] {
+				removed++
+				return nil
+			}
+			seen[key] = true
+			written++
+			return writer.Write(bet)
+		})
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error removing duplicates: %v\n", err)
+		return exitFailure
+	}
+	fmt.Fprintf(os.Stderr, "%v bets written, %v duplicates removed\n", written, removed)
+	return exitOk
+}
+
+func convertCommand(args []string) int {
+	fs := pflag.NewFlagSet("convert", pflag.ContinueOnError)
+	to := fs.String("to", "", "format to convert to: csv or jsonl, taken from the output file extension if not given")
+	output := fs.StringP("output", "o", "", "output file, standard output if empty")
+	files, code, ok := parseFlags(fs, "convert", args, 1, 1)
+	if !ok {
+		return code
+	}
+	if *to == "" && *output == "" {
+		fmt.Fprintf(os.Stderr, "usage: betsctl %v\n", usages["convert"])
+		return exitUsage
+	}
+	format := bets.FormatOf(*output)
+	if *to != "" {
+		var err error
+		if format, err = bets.ParseFormat(*to); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	written := 0
+	err := writeBets(*output, format, func(writer *bets.Writer) error {
+		return forEachBet(files, nil, func(bet *bets.Bet) error {
+			written++
+			return writer.Write(bet)
+		})
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error converting bets: %v\n", err)
+		return exitFailure
+	}
+	fmt.Fprintf(os.Stderr, "%v bets written\n", written)
+	return exitOk
+}
+
+// mergeCommand Writes the bets of every store, in the order given. Tickets
+// of different servers may collide: that's an error unless --renumber is
+// given, in which case every bet gets a new ticket in output order.
+// Cancelled bets are left out before renumbering, as their tombstones
+// wouldn't match the new tickets
+func mergeCommand(args []string) int {
+	fs := pflag.NewFlagSet("merge", pflag.ContinueOnError)
+	renumber := fs.Bool("renumber", false, "assign new tickets to every bet in output order")
+	cancellationsPath := fs.String("cancellations", "", "cancelled bets file, its bets are left out")
+	output := fs.StringP("output", "o", "", "output file, standard output if empty")
+	files, code, ok := parseFlags(fs, "merge", args, 2, 0)
+	if !ok {
+		return code
+	}
+	cancellations, err := loadCancellations(*cancellationsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading cancellations: %v\n", err)
+		return exitFailure
+	}
+
+	seen := make(map[int64]bool)
+	written := int64(0)
+	err = writeBets(*output, outputFormat(*output, files[0]), func(writer *bets.Writer) error {
+		return forEachBet(files, cancellations, func(bet *bets.Bet) error {
+			written++
+			if *renumber {
+				bet.Ticket = written
+			} else if seen[bet.Ticket] {
+				return fmt.Errorf("ticket %v is in more than one store, use --renumber", bet.Ticket)
+			}
+			seen[bet.Ticket] = true
+			return writer.Write(bet)
+		})
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error merging bets: %v\n", err)
+		return exitFailure
+	}
+	fmt.Fprintf(os.Stderr, "%v bets written\n", written)
+	return exitOk
+}
+
+// outputFormat Format of the output file, taken from its extension. When
+// writing to the standard output the format of the input is kept
+func outputFormat(output string, input string) bets.Format {
+	if output == "" {
+		return bets.FormatOf(input)
+	}
+	return bets.FormatOf(output)
+}
+
+// writeBets Calls write with a writer of bets in the given format to the
+// output file, or to the standard output if the path is empty
+func writeBets(path string, format bets.Format, write func(*bets.Writer) error) error {
+	if path == "" {
+		return writeBetsTo(os.Stdout, format, write)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	if err := writeBetsTo(file, format, write); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
+	return nil
+}
+
+func writeBetsTo(out io.Writer, format bets.Format, write func(*bets.Writer) error) error {
+	writer, err := bets.NewWriter(out, format)
+	if err != nil {
+		return err
+	}
+	if err := write(writer); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
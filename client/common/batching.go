@@ -0,0 +1,79 @@
+package common
+
+import "time"
+
+const (
+	// targetLatency Round trip time under which batches keep growing
+	targetLatency = 250 * time.Millisecond
+	// minBatchBytes Smallest target the sizer shrinks batches to
+	minBatchBytes = 512
+	// minBusyBackoff and maxBusyBackoff Bounds of the wait after the server
+	// answers busy
+	minBusyBackoff = 50 * time.Millisecond
+	maxBusyBackoff = 2 * time.Second
+)
+
+// batchSizer Adapts the target size in bytes of the batch payloads to how
+// fast the server acknowledges them. Batches grow by a quarter while the
+// round trip stays under targetLatency and shrink by a quarter when it
+// doesn't. A busy answer halves the target and makes the client wait, twice
+// as long on every busy answer in a row
+type batchSizer struct {
+	target  int
+	min     int
+	max     int
+	backoff time.Duration
+}
+
+// newBatchSizer Returns a sizer that starts at preferred bytes and never
+// goes over max
+func newBatchSizer(preferred int, max int) *batchSizer {
+	s := &batchSizer{target: preferred, min: minBatchBytes, max: max}
+	if s.min > max {
+		s.min = max
+	}
+	s.clamp()
+	return s
+}
+
+// Target Size in bytes the next batch should have
+func (s *batchSizer) Target() int {
+	return s.target
+}
+
+// Acknowledged Adapts the target to the round trip of a batch the server
+// processed
+func (s *batchSizer) Acknowledged(rtt time.Duration) {
+	s.backoff = 0
+	if rtt < targetLatency {
+		s.target += s.target / 4
+	} else {
+		s.target -= s.target / 4
+	}
+	s.clamp()
+}
+
+// Busy Shrinks the target after the server refused a batch for being busy.
+// Returns how long to wait before sending it again
+func (s *batchSizer) Busy() time.Duration {
+	s.target /= 2
+	s.clamp()
+	if s.backoff == 0 {
+		s.backoff = minBusyBackoff
+	} else if s.backoff < maxBusyBackoff {
+		s.backoff *= 2
+		if s.backoff > maxBusyBackoff {
+			s.backoff = maxBusyBackoff
+		}
+	}
+	return s.backoff
+}
+
+func (s *batchSizer) clamp() {
+	if s.target < s.min {
+		s.target = s.min
+	}
+	if s.target > s.max {
+		s.target = s.max
+	}
+}
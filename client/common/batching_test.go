@@ -0,0 +1,60 @@
+package common
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAgencyBatchCutsByBytesAndKeepsTheRestPending(t *testing.T) {
+	input := "Juan,Perez,30904465,1999-03-17,7574\n" +
+		"Maximiliano,Fernandez,30904466,1999-03-17,7575\n" +
+		"Ana,Gomez,30904467,1999-03-17,7576\n"
+	reader, err := NewBetReader(strings.NewReader(input), CSVInput)
+	assert.NoError(t, err)
+	client := NewClient(ClientConfig{ID: 1, MaxAmount: 10, MaxBytes: 86}, bets.Bet{})
+
+	var batches [][][]string
+	for {
+		batch, err := client.LoadAgencyBatch(reader)
+		if len(batch) > 0 {
+			batches = append(batches, batch)
+		}
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+	}
+
+	assert.Len(t, batches, 2)
+	assert.Len(t, batches[0], 1)
+	assert.Equal(t, "Maximiliano", batches[1][0][1])
+	assert.Equal(t, "Ana", batches[1][1][1])
+}
+
+func TestBatchSizerAdaptsToLatencyAndBusyAnswers(t *testing.T) {
+	sizer := newBatchSizer(8192, 16384)
+
+	sizer.Acknowledged(10 * time.Millisecond)
+	assert.Equal(t, 10240, sizer.Target())
+	sizer.Acknowledged(time.Second)
+	assert.Equal(t, 7680, sizer.Target())
+
+	assert.Equal(t, minBusyBackoff, sizer.Busy())
+	assert.Equal(t, 3840, sizer.Target())
+	assert.Equal(t, 2*minBusyBackoff, sizer.Busy())
+	for i := 0; i < 10; i++ {
+		sizer.Busy()
+	}
+	assert.Equal(t, minBatchBytes, sizer.Target())
+	assert.Equal(t, maxBusyBackoff, sizer.Busy())
+
+	for i := 0; i < 20; i++ {
+		sizer.Acknowledged(time.Millisecond)
+	}
+	assert.Equal(t, 16384, sizer.Target())
+}
@@ -1,8 +1,9 @@
 package common
 
 import (
-	"encoding/csv"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -16,6 +17,13 @@ import (
 
 var log = logging.MustGetLogger("log")
 
+// minResultsPoll and maxResultsPoll Bounds of the wait between results
+// queries while the draw is open
+const (
+	minResultsPoll = 100 * time.Millisecond
+	maxResultsPoll = time.Second
+)
+
 // ClientConfig Configuration used by the client
 type ClientConfig struct {
 	ID            int
@@ -23,104 +31,164 @@ type ClientConfig struct {
 	LoopAmount    int
 	LoopPeriod    time.Duration
 	MaxAmount     int
+	MaxBytes      int
+	Window        int
+	// Checksum Whether the frames sent carry a CRC32C trailer
+	Checksum bool
+	// Compression Whether the batches of at least CompressionThreshold
+	// bytes are sent compressed
+	Compression          bool
+	CompressionThreshold int
+	// HeartbeatInterval Time between the Pings sent on every connection, 0
+	// for none. The connection is given up after HeartbeatMisses intervals
+	// without hearing from the server while waiting for it
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+	// ProgressInterval Time between upload progress lines, 0 for none
+	ProgressInterval time.Duration
+	// ResultsTimeout Time SendResultsQuery waits for the draw to close
+	ResultsTimeout time.Duration
+	InputPath      string
+	InputFormat    string
+	RejectsPath    string
+	// WinnersPath File WriteWinners writes to, empty for none
+	WinnersPath   string
+	WinnersFormat string
 }
 
 // Client Entity that encapsulates how
 type Client struct {
-	config   ClientConfig
-	conn     net.Conn
-	Shutdown bool
-	bet      bets.Bet
+	config ClientConfig
+	conn   *shared.Conn
+	bet    bets.Bet
+	// sizer Adapts the batch size while sending, nil until the server
+	// limits are known
+	sizer *batchSizer
+	// maxBets Most bets the server accepts in a batch, 0 if unknown
+	maxBets int
+	// pending Bets already read that go in the next batches
+	pending  [][]string
+	budget   ConnectionBudget
+	progress Progress
 }
 
 // NewClient Initializes a new client receiving the configuration
 // as a parameter
 func NewClient(config ClientConfig, bet bets.Bet) *Client {
 	client := &Client{
-		config:   config,
-		Shutdown: false,
-		bet:      bet,
+		config: config,
+		bet:    bet,
 	}
 	return client
 }
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+// ErrServerUnreachable The client could not connect to the server
+var ErrServerUnreachable = errors.New("server unreachable")
+
+// ErrResultsUnavailable The draw did not close before the results timeout
+var ErrResultsUnavailable = errors.New("results unavailable")
+
+// ErrServerBusy The server kept answering busy to a batch
+var ErrServerBusy = errors.New("server busy")
+
+// ErrInterrupted The client was shut down before finishing
+var ErrInterrupted = errors.New("client shut down")
+
+// createClientSocket Initializes client socket. In case of failure the
+// error is logged and returned wrapping ErrServerUnreachable, or
+// ErrInterrupted once ctx is canceled
+func (c *Client) createClientSocket(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ErrInterrupted
+	}
+	conn, err := c.dial(ctx)
 	if err != nil {
-		if !c.Shutdown {
-			log.Criticalf(
-				"action: connect | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
-			)
+		if ctx.Err() != nil {
+			return ErrInterrupted
 		}
-		return err
+		log.Errorf(
+			"action: connect | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return fmt.Errorf("%w: %v", ErrServerUnreachable, err)
+	}
+	c.conn = shared.NewConn(conn)
+	if c.config.Checksum {
+		c.conn.EnableChecksum()
+	}
+	if c.config.Compression {
+		c.conn.EnableCompression(c.config.CompressionThreshold)
 	}
-	c.conn = conn
+	c.conn.SetHeartbeat(c.config.HeartbeatInterval, c.config.HeartbeatMisses)
+	c.conn.StartHeartbeat()
 	return nil
 }
 
-// SendBatches Send messages to the client until some time threshold is met
-func (c *Client) SendBatches() error {
-	agencyFile, err := os.Open("/agency.csv")
-	if err != nil {
-		log.Errorf("action: load_agency_bets | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
-		)
+// SendBatches Sends every bet of the agency file in batches, keeping up to
+// Window of them in flight, and then tells the server the agency is done
+func (c *Client) SendBatches(ctx context.Context) error {
+	if err := c.UploadBets(ctx); err != nil {
+		return err
+	}
+	if err := c.SendAllBetsSent(ctx); err != nil {
 		return err
 	}
-	defer agencyFile.Close()
-
-	reader := csv.NewReader(agencyFile)
-	reader.Comma = ','
-	reader.FieldsPerRecord = -1
-	eof := false
-	for !c.Shutdown && !eof {
-		// Create the connection the server in every loop iteration. Send an
-		if c.Shutdown {
-			break
-		}
 
-		batch, err := c.LoadAgencyBatch(reader)
-		if err == io.EOF {
-			eof = true
-			if len(batch) == 0 {
-				break
-			}
-		} else if err != nil {
-			log.Errorf("action: load_agency_batch | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
-			)
-			continue
-		}
-		err = c.SendBatch(batch)
-		if err != nil {
-			log.Errorf("action: send_batch | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
-			)
-			continue
-		}
+	summary := c.progress.Summary(c.config.ID)
+	result := "success"
+	if !summary.AllAccepted() {
+		result = "fail"
+	}
+	log.Infof("action: batches_finished | result: %v | client_id: %v | accepted: %v | rejected: %v | skipped_lines: %v",
+		result,
+		c.config.ID,
+		summary.BetsAccepted,
+		summary.BetsRejected,
+		summary.SkippedLines,
+	)
+	return nil
+}
 
+// UploadBets Sends every bet of the agency file in batches, keeping up to
+// Window of them in flight, without telling the server the agency is done
+func (c *Client) UploadBets(ctx context.Context) error {
+	reader, closeFile, err := c.openAgencyBets()
+	if err != nil {
+		return err
 	}
+	defer closeFile()
 
-	allBetsSentMessage := shared.AllBetsSentMessage{
-		Agency: c.config.ID,
+	if c.config.ProgressInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go c.logProgress(c.config.ProgressInterval, done)
 	}
-	messageBytes, err := allBetsSentMessage.Serialize()
+
+	c.loadServerInfo(ctx)
+	err = newBatchPipeline(c, reader).run(ctx)
+	skipped := reader.Skipped()
+	c.progress.finish(len(skipped))
 	if err != nil {
-		log.Errorf("action: serialize_finish_message | result: fail | client_id: %v | error: %v",
+		log.Errorf("action: send_batches | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
 		return err
 	}
-	err = c.createClientSocket()
+
+	c.reportSkippedLines(skipped)
+	c.logSummary()
+	return nil
+}
+
+// SendAllBetsSent Tells the server the agency sent all of its bets, so
+// they take part in the draw
+func (c *Client) SendAllBetsSent(ctx context.Context) error {
+	allBetsSentMessage := shared.AllBetsSentMessage{
+		Agency: c.config.ID,
+	}
+	err := c.createClientSocket(ctx)
 	if err != nil {
 		log.Errorf("action: create_client_socket | result: fail | client_id: %v | error: %v",
 			c.config.ID,
@@ -129,7 +197,7 @@ func (c *Client) SendBatches() error {
 		return err
 	}
 	defer c.conn.Close()
-	err = shared.WriteSafe(c.conn, messageBytes)
+	_, err = c.conn.WriteMessageContext(ctx, &allBetsSentMessage)
 	if err != nil {
 		log.Errorf("action: write_finish_message | result: fail | client_id: %v | error: %v",
 			c.config.ID,
@@ -138,184 +206,548 @@ func (c *Client) SendBatches() error {
 		return err
 	}
 
-	log.Infof("action: batches_finished | result: success | client_id: %v", c.config.ID)
+	log.Infof("action: all_bets_sent | result: success | client_id: %v", c.config.ID)
 	return nil
 }
 
-func (c *Client) SendBatch(batch [][]string) error {
+// SendBatch Sends a single batch on a new connection and returns the
+// server's acknowledgement. SendBatches pipelines the batches instead
+func (c *Client) SendBatch(ctx context.Context, batch [][]string) (*shared.BetResponse, error) {
 
-	err := c.createClientSocket()
+	err := c.createClientSocket(ctx)
 	if err != nil {
 		log.Errorf("action: create_client_socket | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
-		return err
+		return nil, err
 	}
 	defer c.conn.Close()
 
 	batchMessage := shared.BatchBetMessage{
 		ReceivedBets: batch,
 	}
-	messageBytes, err := batchMessage.Serialize()
-	if err != nil {
-		log.Errorf("action: serialize_message | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
-		)
-		return err
-	}
-	err = shared.WriteSafe(c.conn, messageBytes)
+	_, err = c.conn.WriteMessageContext(ctx, &batchMessage)
 	if err != nil {
 		log.Errorf("action: write_message | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
-		return err
+		return nil, err
 	}
 
-	response, err := shared.MessageFromSocket(&c.conn)
+	response, err := c.conn.ReadMessageContext(ctx)
 
 	if err != nil {
 		log.Errorf("action: batch_sent | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
-		return err
+		return nil, err
 	}
 
-	if response.Type != shared.BetResponseType {
+	responseMessage, ok := response.(*shared.BetResponse)
+	if !ok {
 		log.Errorf("action: batch_sent | result: fail | client_id: %v | error: unknown response type %v",
 			c.config.ID,
-			response.Type,
+			response.GetMessageType(),
+		)
+		return nil, errors.New("unknown response type")
+	}
+
+	switch {
+	case responseMessage.Success:
+		log.Infof("action: batch_sent | result: success | client_id: %v | tickets: %v",
+			c.config.ID,
+			ticketRange(responseMessage.Tickets),
+		)
+	case responseMessage.Busy:
+		log.Infof("action: batch_sent | result: busy | client_id: %v | bets: %v",
+			c.config.ID,
+			len(batch),
+		)
+	default:
+		log.Infof("action: batch_sent | result: fail | client_id: %v | tickets: %v",
+			c.config.ID,
+			ticketRange(responseMessage.Tickets),
 		)
-		return errors.New("unknown response type")
 	}
+	return responseMessage, nil
+}
 
-	var responseMessage shared.BetResponse
-	err = responseMessage.Deserialize(response.Payload)
+// loadServerInfo Asks the server for its batch limits and starts adapting
+// the batch size from its preferred one. If the server doesn't answer, the
+// batches start at the configured maximum
+func (c *Client) loadServerInfo(ctx context.Context) {
+	preferred, max := c.config.MaxBytes, c.config.MaxBytes
+	info, err := c.queryServerInfo(ctx)
 	if err != nil {
-		log.Errorf("action: batch_sent | result: fail | client_id: %v | error: %v",
+		log.Warningf("action: server_info | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
-		return err
+	} else {
+		preferred = info.PreferredBatchBytes
+		if info.MaxBatchBytes < max {
+			max = info.MaxBatchBytes
+		}
+		c.maxBets = info.MaxBatchBets
+		log.Infof("action: server_info | result: success | client_id: %v | preferred_batch_bytes: %v | max_batch_bytes: %v | max_batch_bets: %v",
+			c.config.ID,
+			info.PreferredBatchBytes,
+			info.MaxBatchBytes,
+			info.MaxBatchBets,
+		)
+	}
+	c.sizer = newBatchSizer(preferred, max)
+}
+
+func (c *Client) queryServerInfo(ctx context.Context) (*shared.ServerInfoMessage, error) {
+	serverInfoQueryMessage := shared.ServerInfoQueryMessage{
+		Agency: c.config.ID,
+	}
+	err := c.createClientSocket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+
+	_, err = c.conn.WriteMessageContext(ctx, &serverInfoQueryMessage)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.conn.ReadMessageContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	serverInfoMessage, ok := response.(*shared.ServerInfoMessage)
+	if !ok {
+		return nil, fmt.Errorf("unknown response type %v", response.GetMessageType())
+	}
+	return serverInfoMessage, nil
+}
+
+// QueryStatus Asks the server how many bets of the agency it stored,
+// whether the agency already finished and whether the draw is closed
+func (c *Client) QueryStatus(ctx context.Context) (*shared.StatusMessage, error) {
+	statusQueryMessage := shared.StatusQueryMessage{
+		Agency: c.config.ID,
+	}
+	err := c.createClientSocket(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer c.conn.Close()
 
-	if responseMessage {
-		log.Infof("action: batch_sent | result: success | client_id: %v",
+	_, err = c.conn.WriteMessageContext(ctx, &statusQueryMessage)
+	if err != nil {
+		log.Errorf("action: status | result: fail | client_id: %v | error: %v",
 			c.config.ID,
+			err,
 		)
-	} else {
-		log.Infof("action: batch_sent | result: fail | client_id: %v",
+		return nil, err
+	}
+	response, err := c.conn.ReadMessageContext(ctx)
+	statusMessage, ok := response.(*shared.StatusMessage)
+	if err == nil && !ok {
+		err = fmt.Errorf("unknown response type %v", response.GetMessageType())
+	}
+	if err != nil {
+		log.Errorf("action: status | result: fail | client_id: %v | error: %v",
 			c.config.ID,
+			err,
 		)
+		return nil, err
 	}
-	return nil
+	log.Infof("action: status | result: success | client_id: %v | bets: %v | finished: %v | draw_closed: %v",
+		c.config.ID,
+		statusMessage.BetsCommitted,
+		statusMessage.Finished,
+		statusMessage.DrawClosed,
+	)
+	return statusMessage, nil
+}
+
+// logBatchSize Logs the new batch size if it changed from previous
+func (c *Client) logBatchSize(previous int, reason string) {
+	if c.sizer.Target() == previous {
+		return
+	}
+	log.Infof("action: batch_size | result: success | client_id: %v | previous_bytes: %v | bytes: %v | reason: %v",
+		c.config.ID,
+		previous,
+		c.sizer.Target(),
+		reason,
+	)
 }
 
-func (c *Client) SendResultsQuery() error {
+// ticketRange Formats the tickets of a batch acknowledgement for logging
+func ticketRange(tickets []int64) string {
+	if len(tickets) == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%v-%v", tickets[0], tickets[len(tickets)-1])
+}
 
-	resultsQueryMessage := shared.ResultsQueryMessage{
+// CancelBet Asks the server to void the bet with the given ticket. It only
+// succeeds before the agency sends AllBetsSent
+func (c *Client) CancelBet(ctx context.Context, ticket int64) error {
+	cancelBetMessage := shared.CancelBetMessage{
 		Agency: c.config.ID,
+		Ticket: ticket,
 	}
-	messageBytes, err := resultsQueryMessage.Serialize()
+	response, err := c.sendForBetResponse(ctx, &cancelBetMessage)
 	if err != nil {
-		log.Errorf("action: serialize_message | result: fail | client_id: %v | error: %v",
+		log.Errorf("action: apuesta_cancelada | result: fail | client_id: %v | ticket: %v | error: %v",
 			c.config.ID,
+			ticket,
 			err,
 		)
 		return err
 	}
+	if !response.Success {
+		log.Errorf("action: apuesta_cancelada | result: fail | client_id: %v | ticket: %v",
+			c.config.ID,
+			ticket,
+		)
+		return errors.New("bet cancellation rejected")
+	}
 
-	for i := 10; i > 0; i-- {
-		err = c.createClientSocket()
-		if err != nil {
-			log.Errorf("action: create_client_socket | result: fail | client_id: %v | error: %v",
+	log.Infof("action: apuesta_cancelada | result: success | client_id: %v | ticket: %v",
+		c.config.ID,
+		ticket,
+	)
+	return nil
+}
+
+// AmendBet Asks the server to replace the bet with the given ticket by bet.
+// Returns the ticket of the corrected bet
+func (c *Client) AmendBet(ctx context.Context, ticket int64, bet bets.Bet) (int64, error) {
+	bet.Agency = c.config.ID
+	amendBetMessage := shared.AmendBetMessage{
+		Ticket: ticket,
+		Bet:    bet,
+	}
+	response, err := c.sendForBetResponse(ctx, &amendBetMessage)
+	if err != nil {
+		log.Errorf("action: apuesta_corregida | result: fail | client_id: %v | ticket: %v | error: %v",
+			c.config.ID,
+			ticket,
+			err,
+		)
+		return 0, err
+	}
+	if !response.Success || len(response.Tickets) != 1 {
+		log.Errorf("action: apuesta_corregida | result: fail | client_id: %v | ticket: %v | nuevo_ticket: %v",
+			c.config.ID,
+			ticket,
+			ticketRange(response.Tickets),
+		)
+		return 0, errors.New("bet amendment rejected")
+	}
+
+	log.Infof("action: apuesta_corregida | result: success | client_id: %v | ticket: %v | nuevo_ticket: %v",
+		c.config.ID,
+		ticket,
+		response.Tickets[0],
+	)
+	return response.Tickets[0], nil
+}
+
+// sendForBetResponse Sends a message on a new connection and waits for
+// the server's BetResponse
+func (c *Client) sendForBetResponse(ctx context.Context, message shared.Message) (*shared.BetResponse, error) {
+	err := c.createClientSocket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+
+	_, err = c.conn.WriteMessageContext(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.conn.ReadMessageContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	responseMessage, ok := response.(*shared.BetResponse)
+	if !ok {
+		return nil, fmt.Errorf("unknown response type %v", response.GetMessageType())
+	}
+	return responseMessage, nil
+}
+
+// SendResultsQuery Asks the server for the winners of the agency, trying
+// again while the draw is not closed. A server that stops answering the
+// heartbeat is asked again on a new connection. Fails with
+// ErrResultsUnavailable if the draw is still open after ResultsTimeout
+func (c *Client) SendResultsQuery(ctx context.Context) (*Results, error) {
+
+	resultsQueryMessage := shared.ResultsQueryMessage{
+		Agency: c.config.ID,
+	}
+	deadline := time.Now().Add(c.config.ResultsTimeout)
+	wait := minResultsPoll
+	for {
+		response, err := c.sendResultsQuery(ctx, &resultsQueryMessage)
+		if errors.Is(err, shared.ErrPeerUnresponsive) && time.Now().Before(deadline) {
+			log.Infof("action: reconnect | result: in_progress | client_id: %v | reason: %v",
 				c.config.ID,
 				err,
 			)
-			return err
+			continue
 		}
-		defer c.conn.Close()
-		err = shared.WriteSafe(c.conn, messageBytes)
 		if err != nil {
-			log.Errorf("action: write_message | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
-			)
-			return err
+			return nil, err
 		}
 
-		response, err := shared.MessageFromSocket(&c.conn)
-		if err != nil {
-			log.Errorf("action: send_results_query | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
+		switch response := response.(type) {
+		case *shared.ResultsResponseMessage:
+			log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v",
+				len(response.Winners),
 			)
-			return err
-		}
-
-		switch response.Type {
-		case shared.ResultsResponseType:
-			var resultsResponseMessage shared.ResultsResponseMessage
-			err = resultsResponseMessage.Deserialize(response.Payload)
-			if err != nil {
-				log.Errorf("action: send_results_query | result: fail | client_id: %v | error: %v",
+			return newResults(response), nil
+		case *shared.ResultUnavailableMessage:
+			if time.Now().Add(wait).After(deadline) {
+				log.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: draw still open after %v",
 					c.config.ID,
-					err,
+					c.config.ResultsTimeout,
 				)
-				return err
+				return nil, ErrResultsUnavailable
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ErrInterrupted
+			}
+			wait *= 2
+			if wait > maxResultsPoll {
+				wait = maxResultsPoll
 			}
-			log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v",
-				len(resultsResponseMessage.Winners),
-			)
-			return nil
-		case shared.ResultUnavailableType:
-
-			time.Sleep(time.Millisecond * 100)
 		default:
 			log.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: unknown response type %v",
 				c.config.ID,
-				response.Type,
+				response.GetMessageType(),
 			)
-			return errors.New("unknown response type")
+			return nil, errors.New("unknown response type")
 		}
 	}
-	return nil
 }
-func (c *Client) LoadAgencyBatch(reader *csv.Reader) ([][]string, error) {
 
-	var loadedBets [][]string
+// sendResultsQuery Sends the query on a new connection, which is closed
+// once the answer arrives
+func (c *Client) sendResultsQuery(ctx context.Context, query *shared.ResultsQueryMessage) (shared.Message, error) {
+	err := c.createClientSocket(ctx)
+	if err != nil {
+		log.Errorf("action: create_client_socket | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err
+	}
+	defer c.conn.Close()
+	_, err = c.conn.WriteMessageContext(ctx, query)
+	if err != nil {
+		log.Errorf("action: write_message | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err
+	}
 
-	for i := 0; i < c.config.MaxAmount; i++ {
-		record, err := reader.Read()
-		if err == io.EOF {
-			return loadedBets, err
-		} else if err != nil {
-			log.Errorf("action: load_agency_bets | result: fail | client_id: %v | error: %v",
-				c.config.ID, err)
-			return nil, err
-		}
+	response, err := c.conn.ReadMessageContext(ctx)
+	if err != nil {
+		log.Errorf("action: send_results_query | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err
+	}
+	return response, nil
+}
+
+// SendDocumentQuery Asks the server for the bets the person with the given
+// document placed at this agency, with the prize each one won. Fails if the
+// draw is not closed yet
+func (c *Client) SendDocumentQuery(ctx context.Context, document string) ([]shared.BetResult, error) {
+	documentQueryMessage := shared.DocumentQueryMessage{
+		Agency:   c.config.ID,
+		Document: document,
+	}
+	err := c.createClientSocket(ctx)
+	if err != nil {
+		log.Errorf("action: create_client_socket | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err
+	}
+	defer c.conn.Close()
+	_, err = c.conn.WriteMessageContext(ctx, &documentQueryMessage)
+	if err != nil {
+		log.Errorf("action: write_message | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err
+	}
+
+	response, err := c.conn.ReadMessageContext(ctx)
+	if err != nil {
+		log.Errorf("action: consulta_documento | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err
+	}
+
+	switch response := response.(type) {
+	case *shared.DocumentResultsMessage:
+		log.Infof("action: consulta_documento | result: success | client_id: %v | cant_apuestas: %v",
+			c.config.ID,
+			len(response.Results),
+		)
+		return response.Results, nil
+	case *shared.ResultUnavailableMessage:
+		log.Infof("action: consulta_documento | result: fail | client_id: %v | error: results unavailable",
+			c.config.ID,
+		)
+		return nil, errors.New("results unavailable")
+	default:
+		log.Errorf("action: consulta_documento | result: fail | client_id: %v | error: unknown response type %v",
+			c.config.ID,
+			response.GetMessageType(),
+		)
+		return nil, errors.New("unknown response type")
+	}
+}
+
+// openAgencyBets Opens the agency file with a reader that skips the lines
+// the server would reject. The returned function closes the file
+func (c *Client) openAgencyBets() (BetReader, func() error, error) {
+	agencyFile, err := os.Open(c.config.InputPath)
+	if err != nil {
+		log.Errorf("action: load_agency_bets | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, nil, err
+	}
+
+	var fileSize int64
+	if info, err := agencyFile.Stat(); err == nil {
+		fileSize = info.Size()
+	}
+	c.progress.start(fileSize)
+
+	reader, err := NewBetReader(&progressReader{reader: agencyFile, progress: &c.progress}, c.config.InputFormat)
+	if err != nil {
+		agencyFile.Close()
+		log.Errorf("action: load_agency_bets | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, nil, err
+	}
+	return NewValidatingReader(reader, c.config.ID), agencyFile.Close, nil
+}
+
+// LoadAgencyBatch Reads the bets of the next batch and prepends the agency
+// to each one. A batch has up to MaxAmount bets, or the server limit if
+// lower, and its payload stays under the target size, but it always takes
+// at least one bet. Bets left pending by an earlier batch go first. Returns
+// io.EOF along with the last bets once the file is exhausted
+func (c *Client) LoadAgencyBatch(reader BetReader) ([][]string, error) {
+
+	maxBets := c.config.MaxAmount
+	if c.maxBets > 0 && c.maxBets < maxBets {
+		maxBets = c.maxBets
+	}
+	maxBytes := c.config.MaxBytes
+	if c.sizer != nil {
+		maxBytes = c.sizer.Target()
+	}
 
-		recordWithAgency := append([]string{strconv.Itoa(c.config.ID)}, record...)
+	var loadedBets [][]string
+	size := 0
+
+	for len(loadedBets) < maxBets {
+		var recordWithAgency []string
+		if len(c.pending) > 0 {
+			recordWithAgency = c.pending[0]
+			c.pending = c.pending[1:]
+		} else {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return loadedBets, err
+			} else if err != nil {
+				log.Errorf("action: load_agency_bets | result: fail | client_id: %v | error: %v",
+					c.config.ID, err)
+				return nil, err
+			}
+			c.progress.betRead()
+			recordWithAgency = append([]string{strconv.Itoa(c.config.ID)}, record...)
+		}
 
+		length := shared.BatchBetLineLength(recordWithAgency)
+		if len(loadedBets) > 0 && size+length > maxBytes {
+			c.pending = append([][]string{recordWithAgency}, c.pending...)
+			break
+		}
 		loadedBets = append(loadedBets, recordWithAgency)
+		size += length
 	}
 
 	return loadedBets, nil
 
 }
 
-func (c *Client) Cleanup(reason string) {
-	c.Shutdown = true
+// reportSkippedLines Logs every line of the agency file that was not sent
+// and writes them to the rejects file, if there is one
+func (c *Client) reportSkippedLines(skipped []SkippedLine) {
+	if c.config.RejectsPath != "" {
+		if err := WriteRejects(c.config.RejectsPath, skipped); err != nil {
+			log.Errorf("action: write_rejects | result: fail | client_id: %v | file: %v | error: %v",
+				c.config.ID,
+				c.config.RejectsPath,
+				err,
+			)
+		}
+	}
+	for _, line := range skipped {
+		log.Warningf("action: skip_bet_line | result: success | client_id: %v | file: %v | line: %v | reason: %v",
+			c.config.ID,
+			c.config.InputPath,
+			line.Line,
+			line.Reason,
+		)
+	}
+	log.Infof("action: load_agency_bets | result: success | client_id: %v | file: %v | format: %v | skipped_lines: %v | rejects_file: %v",
+		c.config.ID,
+		c.config.InputPath,
+		c.config.InputFormat,
+		len(skipped),
+		c.config.RejectsPath,
+	)
+}
 
+// Cleanup Closes the connection of the client if it is still open. Every
+// call closes the connection it opens once it is done, so there is usually
+// nothing left to close
+func (c *Client) Cleanup(reason string) {
 	if c.conn == nil {
 		return
 	}
 
 	err := c.conn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
 	if err != nil {
-		log.Infof("action: connection_closed | result: success | client_id: %v | reason: %v | closed resource: %v", c.config.ID, reason, err)
+		log.Errorf("action: connection_closed | result: fail | client_id: %v | reason: %v | error: %v", c.config.ID, reason, err)
+		return
 	}
+	log.Infof("action: connection_closed | result: success | client_id: %v | reason: %v", c.config.ID, reason)
 }
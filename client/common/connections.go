@@ -0,0 +1,57 @@
+package common
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ConnectionBudget Caps the connections open at once by the clients that
+// share it. Opening a connection waits for a free slot, closing it gives
+// the slot back
+type ConnectionBudget chan struct{}
+
+// NewConnectionBudget Returns a budget of size connections
+func NewConnectionBudget(size int) ConnectionBudget {
+	return make(ConnectionBudget, size)
+}
+
+// budgetConn A connection that gives its slot back to the budget the first
+// time it is closed
+type budgetConn struct {
+	net.Conn
+	budget ConnectionBudget
+	once   sync.Once
+}
+
+func (c *budgetConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.budget })
+	return err
+}
+
+// SetConnectionBudget Makes the client share the connections budget with
+// other clients. Must be called before the client connects
+func (c *Client) SetConnectionBudget(budget ConnectionBudget) {
+	c.budget = budget
+}
+
+// dial Connects to the server once the budget has a free slot. Gives up
+// waiting for the slot or for the connection once ctx is done
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if c.budget == nil {
+		return dialer.DialContext(ctx, "tcp", c.config.ServerAddress)
+	}
+	select {
+	case c.budget <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", c.config.ServerAddress)
+	if err != nil {
+		<-c.budget
+		return nil, err
+	}
+	return &budgetConn{Conn: conn, budget: c.budget}, nil
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionBudgetIsSharedByClients(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	budget := NewConnectionBudget(1)
+	first := NewClient(ClientConfig{ID: 1, ServerAddress: listener.Addr().String()}, bets.Bet{})
+	second := NewClient(ClientConfig{ID: 2, ServerAddress: listener.Addr().String()}, bets.Bet{})
+	first.SetConnectionBudget(budget)
+	second.SetConnectionBudget(budget)
+
+	assert.NoError(t, first.createClientSocket(context.Background()))
+	connected := make(chan error)
+	go func() { connected <- second.createClientSocket(context.Background()) }()
+
+	select {
+	case <-connected:
+		t.Fatal("second client connected while the budget was used")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.conn.Close()
+	first.conn.Close()
+	assert.NoError(t, <-connected)
+	second.conn.Close()
+	assert.Len(t, budget, 0)
+}
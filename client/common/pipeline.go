@@ -0,0 +1,343 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+const (
+	// reconnectAttempts Times the pipeline tries to connect, or connects
+	// and loses the connection before any acknowledgement, before giving up
+	reconnectAttempts = 5
+	// reconnectDelay Wait before the second attempt, doubled on every other
+	reconnectDelay = 100 * time.Millisecond
+	// busyAttempts Times in a row the pipeline backs off after a busy
+	// answer before giving up
+	busyAttempts = 20
+)
+
+// numberedBatch A batch of the pipeline that was not acknowledged yet
+type numberedBatch struct {
+	id     int64
+	bets   [][]string
+	sent   bool
+	sentAt time.Time
+}
+
+// batchPipeline Sends the agency batches on one connection keeping up to
+// Window of them unacknowledged. The server stores them in order and
+// acknowledges each one by its ID. Batches answered busy and the ones sent
+// on a connection that was lost are sent again, in order, so the server
+// always receives the next one it expects
+type batchPipeline struct {
+	client   *Client
+	reader   BetReader
+	session  int64
+	nextID   int64
+	unacked  []*numberedBatch
+	inFlight int
+	eof      bool
+	resumeAt time.Time
+	// busy Backoffs since the server last stored a batch, at most maxBusy
+	busy    int
+	maxBusy int
+	// acked Whether an acknowledgement arrived on the current connection
+	acked bool
+	// dropped Connections in a row lost before any acknowledgement
+	dropped int
+	acks    chan *shared.BatchAckMessage
+	failed  chan error
+	closed  chan struct{}
+}
+
+func newBatchPipeline(client *Client, reader BetReader) *batchPipeline {
+	return &batchPipeline{
+		client:  client,
+		reader:  reader,
+		session: time.Now().UnixNano(),
+		nextID:  1,
+		maxBusy: busyAttempts,
+	}
+}
+
+// run Sends every batch of the reader and waits for their
+// acknowledgements. Fails if a batch can't be loaded, the server can't be
+// reached or ctx is canceled
+func (p *batchPipeline) run(ctx context.Context) error {
+	defer p.disconnect()
+	for ctx.Err() == nil {
+		if p.closed == nil {
+			if err := p.connect(ctx); err != nil {
+				return err
+			}
+		}
+		if err := p.fill(ctx); err != nil {
+			return err
+		}
+		if len(p.unacked) == 0 && p.eof {
+			return nil
+		}
+		if p.closed == nil {
+			continue
+		}
+		if p.inFlight == 0 {
+			// Every pending batch waits for the busy backoff to be sent again
+			select {
+			case <-time.After(time.Until(p.resumeAt)):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		select {
+		case ack := <-p.acks:
+			if err := p.acknowledge(ack); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+		case err := <-p.failed:
+			if ctx.Err() == nil {
+				log.Errorf("action: batch_ack | result: fail | client_id: %v | unacknowledged: %v | error: %v",
+					p.client.config.ID,
+					len(p.unacked),
+					err,
+				)
+			}
+			p.disconnect()
+		}
+	}
+	return ErrInterrupted
+}
+
+// connect Opens a new connection, retrying a few times, and marks every
+// unacknowledged batch to be sent again on it. Connections lost before any
+// acknowledgement count as failed attempts too: the pipeline waits before
+// opening the next one and gives up after reconnectAttempts in a row
+func (p *batchPipeline) connect(ctx context.Context) error {
+	if p.dropped >= reconnectAttempts {
+		return fmt.Errorf("%w: %v connections in a row lost before any acknowledgement", ErrServerUnreachable, p.dropped)
+	}
+	if p.dropped > 0 {
+		select {
+		case <-time.After(reconnectDelay << (p.dropped - 1)):
+		case <-ctx.Done():
+			return ErrInterrupted
+		}
+	}
+	delay := reconnectDelay
+	for attempt := 1; ; attempt++ {
+		err := p.client.createClientSocket(ctx)
+		if err == nil {
+			break
+		}
+		if attempt == reconnectAttempts || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ErrInterrupted
+		}
+		delay *= 2
+	}
+	if len(p.unacked) > 0 {
+		log.Infof("action: reconnect | result: success | client_id: %v | resent_batches: %v",
+			p.client.config.ID,
+			len(p.unacked),
+		)
+	}
+	for _, batch := range p.unacked {
+		batch.sent = false
+	}
+	p.inFlight = 0
+	p.acked = false
+
+	p.acks = make(chan *shared.BatchAckMessage)
+	p.failed = make(chan error, 1)
+	p.closed = make(chan struct{})
+	go readAcks(ctx, p.client.conn, p.acks, p.failed, p.closed)
+	return nil
+}
+
+// disconnect Closes the connection. Acknowledgements still on their way
+// are lost, their batches are sent again on the next connection
+func (p *batchPipeline) disconnect() {
+	if p.closed == nil {
+		return
+	}
+	if !p.acked {
+		p.dropped++
+	}
+	close(p.closed)
+	p.closed = nil
+	p.client.conn.Close()
+}
+
+// readAcks Passes every acknowledgement read from conn to acks until the
+// connection fails, closed is closed or ctx is canceled
+func readAcks(ctx context.Context, conn *shared.Conn, acks chan<- *shared.BatchAckMessage, failed chan<- error, closed <-chan struct{}) {
+	for {
+		message, err := conn.ReadMessageContext(ctx)
+		ack, ok := message.(*shared.BatchAckMessage)
+		if err == nil && !ok {
+			err = fmt.Errorf("unknown response type %v", message.GetMessageType())
+		}
+		if err != nil {
+			failed <- err
+			return
+		}
+		select {
+		case acks <- ack:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// fill Sends batches until the window is full or there is nothing to send
+// yet. A failed write drops the connection, the batches are sent again
+// after reconnecting
+func (p *batchPipeline) fill(ctx context.Context) error {
+	for p.closed != nil && p.inFlight < p.client.config.Window {
+		batch, err := p.nextBatch()
+		if err != nil || batch == nil {
+			return err
+		}
+
+		message := shared.NumberedBatchMessage{
+			Agency:       p.client.config.ID,
+			Session:      p.session,
+			BatchID:      batch.id,
+			ReceivedBets: batch.bets,
+		}
+		written, err := p.client.conn.WriteMessageContext(ctx, &message)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("action: write_message | result: fail | client_id: %v | batch: %v | error: %v",
+					p.client.config.ID,
+					batch.id,
+					err,
+				)
+			}
+			p.disconnect()
+			return nil
+		}
+		p.client.progress.batchSent(len(batch.bets), written, !batch.sentAt.IsZero())
+		batch.sent = true
+		batch.sentAt = time.Now()
+		p.inFlight++
+	}
+	return nil
+}
+
+// nextBatch Returns the batch to send next: the first one waiting to be
+// sent again or else a new one from the reader. Returns nil if batches
+// must be sent again but later ones are still in flight or the busy
+// backoff has not passed, or if the reader is exhausted
+func (p *batchPipeline) nextBatch() (*numberedBatch, error) {
+	for i, batch := range p.unacked {
+		if batch.sent {
+			continue
+		}
+		for _, later := range p.unacked[i+1:] {
+			if later.sent {
+				return nil, nil
+			}
+		}
+		if time.Now().Before(p.resumeAt) {
+			return nil, nil
+		}
+		return batch, nil
+	}
+
+	if p.eof {
+		return nil, nil
+	}
+	bets, err := p.client.LoadAgencyBatch(p.reader)
+	if err != nil && err != io.EOF {
+		log.Errorf("action: load_agency_batch | result: fail | client_id: %v | error: %v",
+			p.client.config.ID,
+			err,
+		)
+		return nil, err
+	}
+	p.eof = err == io.EOF
+	if len(bets) == 0 {
+		return nil, nil
+	}
+	batch := &numberedBatch{id: p.nextID, bets: bets}
+	p.nextID++
+	p.unacked = append(p.unacked, batch)
+	return batch, nil
+}
+
+// acknowledge Settles the batch the acknowledgement refers to. A busy
+// batch is kept to be sent again after a backoff, which also makes the
+// batches size shrink. Fails with ErrServerBusy once the server answered
+// busy more than maxBusy times in a row
+func (p *batchPipeline) acknowledge(ack *shared.BatchAckMessage) error {
+	p.acked = true
+	p.dropped = 0
+	index := -1
+	for i, batch := range p.unacked {
+		if batch.id == ack.BatchID && batch.sent {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return nil
+	}
+	batch := p.unacked[index]
+	batch.sent = false
+	p.inFlight--
+
+	sizer := p.client.sizer
+	previous := sizer.Target()
+	if ack.Response.Busy {
+		log.Infof("action: batch_sent | result: busy | client_id: %v | batch: %v | bets: %v",
+			p.client.config.ID,
+			batch.id,
+			len(batch.bets),
+		)
+		// The batches after a busy one are answered busy too, only the
+		// first one backs off
+		for _, other := range p.unacked[:index] {
+			if !other.sent {
+				return nil
+			}
+		}
+		p.busy++
+		if p.busy > p.maxBusy {
+			return fmt.Errorf("%w: batch %v answered busy %v times in a row", ErrServerBusy, batch.id, p.busy)
+		}
+		p.resumeAt = time.Now().Add(sizer.Busy())
+		p.client.logBatchSize(previous, "server busy")
+		return nil
+	}
+	p.busy = 0
+
+	p.unacked = append(p.unacked[:index], p.unacked[index+1:]...)
+	p.client.progress.batchAcknowledged(len(batch.bets), ack.Response)
+	if ack.Response.Success {
+		log.Infof("action: batch_sent | result: success | client_id: %v | batch: %v | tickets: %v",
+			p.client.config.ID,
+			batch.id,
+			ticketRange(ack.Response.Tickets),
+		)
+	} else {
+		log.Infof("action: batch_sent | result: fail | client_id: %v | batch: %v | tickets: %v",
+			p.client.config.ID,
+			batch.id,
+			ticketRange(ack.Response.Tickets),
+		)
+	}
+	rtt := time.Since(batch.sentAt)
+	sizer.Acknowledged(rtt)
+	p.client.logBatchSize(previous, fmt.Sprintf("round trip %v", rtt.Round(time.Millisecond)))
+	return nil
+}
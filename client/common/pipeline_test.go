@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineGivesUpWhenTheServerKeepsAnsweringBusy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *shared.Conn) {
+				defer conn.Close()
+				for {
+					message, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					batch := message.(*shared.NumberedBatchMessage)
+					ack := shared.BatchAckMessage{BatchID: batch.BatchID, Response: shared.BetResponse{Busy: true}}
+					if _, err := conn.WriteMessage(&ack); err != nil {
+						return
+					}
+				}
+			}(shared.NewConn(conn))
+		}
+	}()
+
+	reader, err := NewBetReader(strings.NewReader("Juan,Perez,30904465,1999-03-17,7574\n"), CSVInput)
+	assert.NoError(t, err)
+	client := NewClient(ClientConfig{ID: 1, ServerAddress: listener.Addr().String(), MaxAmount: 10, MaxBytes: 8192, Window: 4}, bets.Bet{})
+	client.sizer = newBatchSizer(8192, 8192)
+	pipeline := newBatchPipeline(client, reader)
+	pipeline.maxBusy = 2
+
+	err = pipeline.run(context.Background())
+	assert.True(t, errors.Is(err, ErrServerBusy), "unexpected error: %v", err)
+	assert.Equal(t, 3, pipeline.busy)
+}
+
+func TestPipelineGivesUpWhenTheServerKeepsClosingTheConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	accepted := make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	reader, err := NewBetReader(strings.NewReader("Juan,Perez,30904465,1999-03-17,7574\n"), CSVInput)
+	assert.NoError(t, err)
+	client := NewClient(ClientConfig{ID: 1, ServerAddress: listener.Addr().String(), MaxAmount: 10, MaxBytes: 8192, Window: 4}, bets.Bet{})
+	client.sizer = newBatchSizer(8192, 8192)
+	pipeline := newBatchPipeline(client, reader)
+
+	err = pipeline.run(context.Background())
+	assert.True(t, errors.Is(err, ErrServerUnreachable), "unexpected error: %v", err)
+	assert.Len(t, accepted, reconnectAttempts)
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+// Progress Counters of the upload of an agency file. Safe for concurrent
+// use
+type Progress struct {
+	mutex          sync.Mutex
+	started        time.Time
+	finished       time.Time
+	fileSize       int64
+	fileRead       int64
+	betsRead       int
+	betsSent       int
+	betsAccepted   int
+	betsRejected   int
+	linesSkipped   int
+	bytesSent      int64
+	batchesSent    int
+	batchesRetried int
+}
+
+// UploadSummary Totals of the upload of an agency. BetsRead counts the
+// bets read from the file that could be sent, SkippedLines the lines that
+// were not sent at all
+type UploadSummary struct {
+	Agency         int     `json:"agency"`
+	BetsRead       int     `json:"bets_read"`
+	BetsSent       int     `json:"bets_sent"`
+	BetsAccepted   int     `json:"bets_accepted"`
+	BetsRejected   int     `json:"bets_rejected"`
+	SkippedLines   int     `json:"skipped_lines"`
+	BytesSent      int64   `json:"bytes_sent"`
+	BatchesSent    int     `json:"batches_sent"`
+	BatchesRetried int     `json:"batches_retried"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	BetsPerSecond  float64 `json:"bets_per_second"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// FileProgress Fraction of the agency file read, from 0 to 1
+	FileProgress float64 `json:"file_progress"`
+	// Remaining Estimated time left to read the rest of the file, based on
+	// how fast it was read so far
+	Remaining time.Duration `json:"-"`
+}
+
+// AllAccepted Whether every line of the agency file was sent and accepted
+func (s UploadSummary) AllAccepted() bool {
+	return s.SkippedLines == 0 && s.BetsRejected == 0 && s.BetsAccepted == s.BetsRead
+}
+
+// start Starts timing the upload of a file of the given size in bytes
+func (p *Progress) start(fileSize int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.started = time.Now()
+	p.fileSize = fileSize
+}
+
+// finish Stops timing the upload. skipped is the amount of lines of the
+// file that were not sent
+func (p *Progress) finish(skipped int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.finished = time.Now()
+	p.linesSkipped = skipped
+}
+
+func (p *Progress) fileBytesRead(n int) {
+	p.mutex.Lock()
+	p.fileRead += int64(n)
+	p.mutex.Unlock()
+}
+
+func (p *Progress) betRead() {
+	p.mutex.Lock()
+	p.betsRead++
+	p.mutex.Unlock()
+}
+
+// batchSent Counts a batch written to the server, retried tells if it had
+// already been sent before
+func (p *Progress) batchSent(bets int, bytes int, retried bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.bytesSent += int64(bytes)
+	if retried {
+		p.batchesRetried++
+		return
+	}
+	p.batchesSent++
+	p.betsSent += bets
+}
+
+// batchAcknowledged Counts the bets of a batch the server accepted, the
+// ones with a ticket, and the ones it rejected. A successful batch
+// acknowledged again without its tickets, which the server no longer
+// remembers, had every bet accepted
+func (p *Progress) batchAcknowledged(bets int, response shared.BetResponse) {
+	accepted := 0
+	for _, ticket := range response.Tickets {
+		if ticket != 0 {
+			accepted++
+		}
+	}
+	if response.Success && len(response.Tickets) == 0 {
+		accepted = bets
+	}
+	p.mutex.Lock()
+	p.betsAccepted += accepted
+	p.betsRejected += bets - accepted
+	p.mutex.Unlock()
+}
+
+// Summary Returns the totals so far
+func (p *Progress) Summary(agency int) UploadSummary {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	summary := UploadSummary{
+		Agency:         agency,
+		BetsRead:       p.betsRead,
+		BetsSent:       p.betsSent,
+		BetsAccepted:   p.betsAccepted,
+		BetsRejected:   p.betsRejected,
+		SkippedLines:   p.linesSkipped,
+		BytesSent:      p.bytesSent,
+		BatchesSent:    p.batchesSent,
+		BatchesRetried: p.batchesRetried,
+	}
+	if p.started.IsZero() {
+		return summary
+	}
+	end := p.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(p.started)
+	summary.ElapsedSeconds = elapsed.Seconds()
+	if elapsed > 0 {
+		summary.BetsPerSecond = float64(p.betsAccepted) / elapsed.Seconds()
+		summary.BytesPerSecond = float64(p.bytesSent) / elapsed.Seconds()
+	}
+	if p.fileSize > 0 {
+		summary.FileProgress = float64(p.fileRead) / float64(p.fileSize)
+		if summary.FileProgress > 1 {
+			summary.FileProgress = 1
+		}
+	}
+	if p.fileRead > 0 && p.fileRead < p.fileSize {
+		summary.Remaining = time.Duration(float64(elapsed) * float64(p.fileSize-p.fileRead) / float64(p.fileRead))
+	}
+	return summary
+}
+
+// progressReader Counts the bytes read from the agency file
+type progressReader struct {
+	reader   io.Reader
+	progress *Progress
+}
+
+func (r *progressReader) Read(buffer []byte) (int, error) {
+	n, err := r.reader.Read(buffer)
+	r.progress.fileBytesRead(n)
+	return n, err
+}
+
+// logProgress Logs the progress of the upload every interval until done is
+// closed
+func (c *Client) logProgress(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		summary := c.progress.Summary(c.config.ID)
+		log.Infof("action: upload_progress | result: in_progress | client_id: %v | bets_read: %v | bets_sent: %v | accepted: %v | rejected: %v | bytes_sent: %v | batches_retried: %v | bets_per_second: %.0f | file_progress: %.0f%% | eta: %v",
+			c.config.ID,
+			summary.BetsRead,
+			summary.BetsSent,
+			summary.BetsAccepted,
+			summary.BetsRejected,
+			summary.BytesSent,
+			summary.BatchesRetried,
+			summary.BetsPerSecond,
+			summary.FileProgress*100,
+			summary.Remaining.Round(time.Second),
+		)
+	}
+}
+
+// logSummary Logs the totals of the finished upload
+func (c *Client) logSummary() {
+	summary := c.progress.Summary(c.config.ID)
+	result := "success"
+	if !summary.AllAccepted() {
+		result = "fail"
+	}
+	log.Infof("action: upload_summary | result: %v | client_id: %v | bets_read: %v | bets_sent: %v | accepted: %v | rejected: %v | skipped_lines: %v | bytes_sent: %v | batches_sent: %v | batches_retried: %v | elapsed: %.2fs | bets_per_second: %.0f | bytes_per_second: %.0f",
+		result,
+		c.config.ID,
+		summary.BetsRead,
+		summary.BetsSent,
+		summary.BetsAccepted,
+		summary.BetsRejected,
+		summary.SkippedLines,
+		summary.BytesSent,
+		summary.BatchesSent,
+		summary.BatchesRetried,
+		summary.ElapsedSeconds,
+		summary.BetsPerSecond,
+		summary.BytesPerSecond,
+	)
+}
+
+// UploadProgress Returns the totals of the upload so far
+func (c *Client) UploadProgress() UploadSummary {
+	return c.progress.Summary(c.config.ID)
+}
+
+// WriteSummaries Writes the upload summaries of every agency to a JSON
+// file at path, along with whether every bet of every agency was accepted
+func WriteSummaries(path string, summaries []UploadSummary) error {
+	allAccepted := true
+	for _, summary := range summaries {
+		allAccepted = allAccepted && summary.AllAccepted()
+	}
+	content, err := json.MarshalIndent(struct {
+		AllAccepted bool            `json:"all_accepted"`
+		Agencies    []UploadSummary `json:"agencies"`
+	}{allAccepted, summaries}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding summary: %v", err)
+	}
+	if err := os.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing summary: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressSummaryTellsIfEveryBetWasAccepted(t *testing.T) {
+	var progress Progress
+	progress.start(100)
+	progress.fileBytesRead(50)
+	for i := 0; i < 3; i++ {
+		progress.betRead()
+	}
+	progress.batchSent(3, 120, false)
+	progress.batchSent(3, 120, true)
+	progress.batchAcknowledged(3, shared.BetResponse{Tickets: []int64{7, 0, 8}})
+	progress.finish(0)
+
+	summary := progress.Summary(1)
+	assert.Equal(t, 3, summary.BetsSent)
+	assert.Equal(t, 2, summary.BetsAccepted)
+	assert.Equal(t, 1, summary.BetsRejected)
+	assert.Equal(t, int64(240), summary.BytesSent)
+	assert.Equal(t, 1, summary.BatchesRetried)
+	assert.Equal(t, 0.5, summary.FileProgress)
+	assert.False(t, summary.AllAccepted())
+
+	summary.BetsRejected, summary.BetsAccepted = 0, 3
+	assert.True(t, summary.AllAccepted())
+
+	// Acknowledged again by a server that no longer remembers the tickets
+	var resent Progress
+	resent.batchAcknowledged(3, shared.BetResponse{Success: true})
+	assert.Equal(t, 3, resent.Summary(1).BetsAccepted)
+}
@@ -0,0 +1,282 @@
+package common
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Formats of the agency bets file
+const (
+	// CSVInput Comma separated, without header: first name, last name,
+	// document, birth date and number
+	CSVInput = "csv"
+	// HeaderCSVInput Comma separated, with a header row naming the columns
+	HeaderCSVInput = "csv-header"
+	// TSVInput Tab separated, same columns as CSVInput
+	TSVInput = "tsv"
+	// JSONLInput One JSON object per line
+	JSONLInput = "jsonl"
+	// FixedWidthInput Legacy export with every column padded with spaces to
+	// the width in fixedWidthColumns
+	FixedWidthInput = "fixed"
+)
+
+// betFields Amount of fields of a bet in an agency file. The agency is not
+// part of the file
+const betFields = 5
+
+// fixedWidthColumns Width of each column of the fixed-width format
+var fixedWidthColumns = [betFields]int{30, 30, 10, 10, 5}
+
+// headerColumns Names a header may give to each column, in bet order
+var headerColumns = [betFields][]string{
+	{"nombre", "first_name", "firstname"},
+	{"apellido", "last_name", "lastname"},
+	{"documento", "dni", "document"},
+	{"nacimiento", "birth_date", "birthdate"},
+	{"numero", "número", "number"},
+}
+
+// SkippedLine A line of the agency file that was not sent and why. Fields
+// holds what could be read of it
+type SkippedLine struct {
+	Line   int
+	Reason string
+	Fields []string
+}
+
+// BetReader Reads the bets of an agency file one at a time
+type BetReader interface {
+	// Read Returns the fields of the next bet: first name, last name,
+	// document, birth date and number. Lines that can't be read as a bet are
+	// skipped and recorded. Returns io.EOF once the file is exhausted
+	Read() ([]string, error)
+	// Line Line number of the bet last returned by Read
+	Line() int
+	// Skipped Lines skipped so far, in file order
+	Skipped() []SkippedLine
+}
+
+// NewBetReader Returns a reader of the agency file r in the given format.
+// It fails if the format is unknown or, for HeaderCSVInput, the header
+// lacks a column
+func NewBetReader(r io.Reader, format string) (BetReader, error) {
+	switch format {
+	case CSVInput:
+		return newCSVBetReader(r, nil), nil
+	case HeaderCSVInput:
+		return newHeaderCSVBetReader(r)
+	case TSVInput:
+		return &betReader{next: lineSource(r, parseTSVLine)}, nil
+	case JSONLInput:
+		return &betReader{next: lineSource(r, parseJSONLine)}, nil
+	case FixedWidthInput:
+		return &betReader{next: lineSource(r, parseFixedWidthLine)}, nil
+	}
+	return nil, fmt.Errorf("unknown input format %q", format)
+}
+
+// betReader Reads bets from next, which returns the line number and fields
+// of each record, or the reason to skip it
+type betReader struct {
+	next    func() (line int, fields []string, skip string, err error)
+	line    int
+	skipped []SkippedLine
+}
+
+func (r *betReader) Read() ([]string, error) {
+	for {
+		line, fields, skip, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if skip == "" {
+			skip = checkBetFields(fields)
+		}
+		if skip != "" {
+			r.skipped = append(r.skipped, SkippedLine{Line: line, Reason: skip, Fields: fields})
+			continue
+		}
+		r.line = line
+		return fields, nil
+	}
+}
+
+func (r *betReader) Line() int {
+	return r.line
+}
+
+func (r *betReader) Skipped() []SkippedLine {
+	return r.skipped
+}
+
+// checkBetFields Returns why the fields can't be a bet, or "" if they can
+func checkBetFields(fields []string) string {
+	if len(fields) != betFields {
+		return fmt.Sprintf("expected %v fields, got %v", betFields, len(fields))
+	}
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+		if fields[i] == "" {
+			return fmt.Sprintf("empty %v", headerColumns[i][0])
+		}
+	}
+	return ""
+}
+
+// newCSVBetReader Reads comma separated records. columns tells the index of
+// each bet field in a record, nil means the fields are in bet order
+func newCSVBetReader(r io.Reader, columns []int) *betReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	return &betReader{next: func() (int, []string, string, error) {
+		record, err := reader.Read()
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			return parseError.StartLine, nil, parseError.Err.Error(), nil
+		}
+		if err != nil {
+			return 0, nil, "", err
+		}
+		line, _ := reader.FieldPos(0)
+		if columns == nil {
+			return line, record, "", nil
+		}
+
+		fields := make([]string, betFields)
+		for i, column := range columns {
+			if column >= len(record) {
+				return line, nil, fmt.Sprintf("expected at least %v fields, got %v", column+1, len(record)), nil
+			}
+			fields[i] = record[column]
+		}
+		return line, fields, "", nil
+	}}
+}
+
+// newHeaderCSVBetReader Reads the header row to find each column, which
+// may come in any order and along with columns that are not used
+func newHeaderCSVBetReader(r io.Reader) (BetReader, error) {
+	buffered := bufio.NewReader(r)
+	headerLine, err := buffered.ReadString('\n')
+	if err == io.EOF && headerLine == "" {
+		return &betReader{next: func() (int, []string, string, error) { return 0, nil, "", io.EOF }}, nil
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+	header, err := csv.NewReader(strings.NewReader(headerLine)).Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+
+	columns := make([]int, betFields)
+	for i, names := range headerColumns {
+		columns[i] = -1
+		for column, name := range header {
+			if containsName(names, strings.ToLower(strings.TrimSpace(name))) {
+				columns[i] = column
+				break
+			}
+		}
+		if columns[i] == -1 {
+			return nil, fmt.Errorf("header has no %v column", names[0])
+		}
+	}
+
+	reader := newCSVBetReader(buffered, columns)
+	next := reader.next
+	// Line numbers are counted after the header
+	reader.next = func() (int, []string, string, error) {
+		line, fields, skip, err := next()
+		return line + 1, fields, skip, err
+	}
+	return reader, nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, candidate := range names {
+		if candidate == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lineSource Returns the records parse makes of every non empty line of r
+func lineSource(r io.Reader, parse func(line string) ([]string, string)) func() (int, []string, string, error) {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	return func() (int, []string, string, error) {
+		for scanner.Scan() {
+			line++
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			fields, skip := parse(scanner.Text())
+			return line, fields, skip, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return line, nil, "", err
+		}
+		return line, nil, "", io.EOF
+	}
+}
+
+func parseTSVLine(line string) ([]string, string) {
+	return strings.Split(strings.TrimRight(line, "\r"), "\t"), ""
+}
+
+// jsonLineBet A bet in the JSONL format. The number may also come as a
+// string
+type jsonLineBet struct {
+	FirstName string          `json:"first_name"`
+	LastName  string          `json:"last_name"`
+	Document  string          `json:"document"`
+	BirthDate string          `json:"birth_date"`
+	Number    json.RawMessage `json:"number"`
+}
+
+func parseJSONLine(line string) ([]string, string) {
+	var bet jsonLineBet
+	if err := json.Unmarshal([]byte(line), &bet); err != nil {
+		return nil, fmt.Sprintf("invalid JSON: %v", err)
+	}
+	number := string(bet.Number)
+	var quoted string
+	if json.Unmarshal(bet.Number, &quoted) == nil {
+		number = quoted
+	}
+	return []string{bet.FirstName, bet.LastName, bet.Document, bet.BirthDate, number}, ""
+}
+
+// parseFixedWidthLine Cuts the line at the column widths, counted in
+// characters. Trailing spaces of the last column may be missing
+func parseFixedWidthLine(line string) ([]string, string) {
+	characters := []rune(strings.TrimRight(line, "\r"))
+	width := 0
+	for _, columnWidth := range fixedWidthColumns {
+		width += columnWidth
+	}
+	lastColumn := width - fixedWidthColumns[betFields-1]
+	if len(characters) <= lastColumn || len(characters) > width {
+		return nil, fmt.Sprintf("expected a line of up to %v characters with every column, got %v characters", width, len(characters))
+	}
+
+	fields := make([]string, 0, betFields)
+	start := 0
+	for _, columnWidth := range fixedWidthColumns {
+		end := start + columnWidth
+		if end > len(characters) {
+			end = len(characters)
+		}
+		fields = append(fields, string(characters[start:end]))
+		start = end
+	}
+	return fields, ""
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAll(t *testing.T, input string, format string) ([][]string, []SkippedLine) {
+	reader, err := NewBetReader(strings.NewReader(input), format)
+	assert.NoError(t, err)
+	var read [][]string
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return read, reader.Skipped()
+		}
+		assert.NoError(t, err)
+		read = append(read, fields)
+	}
+}
+
+func TestBetReaderReadsEveryFormatAndReportsSkippedLines(t *testing.T) {
+	expected := [][]string{{"Juan", "Perez", "30904465", "1999-03-17", "7574"}}
+	inputs := map[string]string{
+		CSVInput:       "Juan,Perez,30904465,1999-03-17,7574\nJuan,Perez\n",
+		HeaderCSVInput: "numero,documento,extra,nombre,apellido,nacimiento\n7574,30904465,x,Juan,Perez,1999-03-17\n7574,,x,Juan,Perez,1999-03-17\n",
+		TSVInput:       "Juan\tPerez\t30904465\t1999-03-17\t7574\nJuan,Perez,30904465,1999-03-17,7574\n",
+		JSONLInput:     `{"first_name":"Juan","last_name":"Perez","document":"30904465","birth_date":"1999-03-17","number":7574}` + "\n{not json\n",
+		FixedWidthInput: "Juan                          Perez                         30904465  1999-03-177574\n" +
+			"Juan Perez 30904465 1999-03-17 7574\n",
+	}
+
+	for format, input := range inputs {
+		read, skipped := readAll(t, input, format)
+		assert.Equal(t, expected, read, format)
+		assert.Len(t, skipped, 1, format)
+		if len(skipped) == 1 {
+			// The header takes the first line
+			line := 2
+			if format == HeaderCSVInput {
+				line = 3
+			}
+			assert.Equal(t, line, skipped[0].Line, format)
+		}
+	}
+}
+
+func TestHeaderCSVBetReaderRequiresEveryColumn(t *testing.T) {
+	_, err := NewBetReader(strings.NewReader("nombre,apellido,documento,nacimiento\n"), HeaderCSVInput)
+	assert.EqualError(t, err, "header has no numero column")
+}
+
+func TestValidatingReaderSkipsBetsTheServerWouldReject(t *testing.T) {
+	input := "Juan,Perez,30904465,1999-03-17,7574\nAna,Gomez,1234,2000-13-01,12\nbad\nAna,Gomez,1234,2000-01-01,doce\n" +
+		"Ana;Maria,Gomez,1234,2000-01-01,12\n\"Ana\rMaria\",Gomez,1234,2000-01-01,12\n"
+	reader, err := NewBetReader(strings.NewReader(input), CSVInput)
+	assert.NoError(t, err)
+	reader = NewValidatingReader(reader, 1)
+
+	fields, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "Juan", fields[0])
+	_, err = reader.Read()
+	assert.Equal(t, io.EOF, err)
+
+	skipped := reader.Skipped()
+	assert.Len(t, skipped, 5)
+	for i, line := range skipped {
+		assert.Equal(t, i+2, line.Line)
+	}
+	assert.Equal(t, []string{"Ana", "Gomez", "1234", "2000-01-01", "doce"}, skipped[2].Fields)
+	// Separators of the batch format would split the bet on the server
+	assert.Equal(t, "Ana;Maria", skipped[3].Fields[0])
+	assert.Equal(t, "Ana\rMaria", skipped[4].Fields[0])
+}
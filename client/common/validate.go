@@ -0,0 +1,141 @@
+package common
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+)
+
+// validatingReader Drops the bets the server would reject, checking them
+// with the same rules the server uses
+type validatingReader struct {
+	BetReader
+	agency   string
+	rejected []SkippedLine
+}
+
+// NewValidatingReader Returns a reader of the bets of reader that the
+// server would accept from agency. The ones it would reject are skipped
+// along with the lines reader skips
+func NewValidatingReader(reader BetReader, agency int) BetReader {
+	return &validatingReader{BetReader: reader, agency: strconv.Itoa(agency)}
+}
+
+func (r *validatingReader) Read() ([]string, error) {
+	for {
+		fields, err := r.BetReader.Read()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := bets.ParseBet(append([]string{r.agency}, fields...)); err != nil {
+			r.rejected = append(r.rejected, SkippedLine{Line: r.Line(), Reason: err.Error(), Fields: fields})
+			continue
+		}
+		return fields, nil
+	}
+}
+
+func (r *validatingReader) Skipped() []SkippedLine {
+	skipped := append([]SkippedLine{}, r.BetReader.Skipped()...)
+	skipped = append(skipped, r.rejected...)
+	sort.SliceStable(skipped, func(i, j int) bool { return skipped[i].Line < skipped[j].Line })
+	return skipped
+}
+
+// WriteRejects Writes the skipped lines to a CSV file at path: line number,
+// reason and whatever fields could be read
+func WriteRejects(path string, skipped []SkippedLine) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	if err := writeRejects(file, skipped); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
+	return nil
+}
+
+func writeRejects(w io.Writer, skipped []SkippedLine) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"line", "reason", "nombre", "apellido", "documento", "nacimiento", "numero"})
+	for _, line := range skipped {
+		record := append([]string{strconv.Itoa(line.Line), line.Reason}, line.Fields...)
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("error writing record: %v", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error writing record: %v", err)
+	}
+	return nil
+}
+
+// DryRunSummary What sending the agency file would do
+type DryRunSummary struct {
+	Lines      int
+	Valid      int
+	Rejected   int
+	Duplicates int
+	Batches    int
+}
+
+// Print Writes the summary, one value per line
+func (s DryRunSummary) Print(w io.Writer) {
+	fmt.Fprintf(w, "lines: %v\n", s.Lines)
+	fmt.Fprintf(w, "valid: %v\n", s.Valid)
+	fmt.Fprintf(w, "rejected: %v\n", s.Rejected)
+	fmt.Fprintf(w, "duplicates: %v\n", s.Duplicates)
+	fmt.Fprintf(w, "batches: %v\n", s.Batches)
+}
+
+// DryRun Reads and validates the whole agency file as SendBatches would,
+// without connecting to the server. The rejected lines are written to the
+// rejects file. Duplicates are valid bets equal to an earlier one; they are
+// counted but would still be sent
+func (c *Client) DryRun() (DryRunSummary, error) {
+	var summary DryRunSummary
+	reader, closeFile, err := c.openAgencyBets()
+	if err != nil {
+		return summary, err
+	}
+	defer closeFile()
+
+	seen := make(map[string]bool)
+	for {
+		batch, err := c.LoadAgencyBatch(reader)
+		if err != nil && err != io.EOF {
+			return summary, err
+		}
+		if len(batch) > 0 {
+			summary.Batches++
+		}
+		for _, bet := range batch {
+			summary.Valid++
+			key := strings.Join(bet, "\x00")
+			if seen[key] {
+				summary.Duplicates++
+			}
+			seen[key] = true
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	skipped := reader.Skipped()
+	summary.Rejected = len(skipped)
+	summary.Lines = summary.Valid + summary.Rejected
+	c.reportSkippedLines(skipped)
+	return summary, nil
+}
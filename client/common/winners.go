@@ -0,0 +1,201 @@
+package common
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+// Results Winners of an agency as the server sent them. Checksum is the
+// SHA-256 of the results payload, the same digest the server records in
+// its audit log when it answers the query
+type Results struct {
+	Winners  []bets.Winner
+	Checksum string
+}
+
+// newResults Returns the results the server sent in a results response
+func newResults(response *shared.ResultsResponseMessage) *Results {
+	payload, _ := response.SerializePayload()
+	return &Results{Winners: response.Winners, Checksum: shared.Digest(payload)}
+}
+
+// WinnerRecord A winner joined with its bet in the agency file. The bet
+// fields are empty if no winning bet of the file has its document
+type WinnerRecord struct {
+	Ticket    int64  `json:"ticket"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Document  string `json:"document"`
+	Number    int    `json:"number"`
+	Prize     string `json:"prize"`
+}
+
+// WinnersFile Content of the winners file of an agency
+type WinnersFile struct {
+	Agency   int            `json:"agency"`
+	Checksum string         `json:"checksum"`
+	Winners  []WinnerRecord `json:"winners"`
+}
+
+// JoinWinners Joins each winner with a winning bet of the agency file that
+// has its document. Each bet is used for a single winner, in file order.
+// Returns the records in the order of the winners and how many of them had
+// no bet in the file. A nil reader joins no bets
+func JoinWinners(winners []bets.Winner, reader BetReader, agency int) ([]WinnerRecord, int, error) {
+	agencyField := strconv.Itoa(agency)
+	byDocument := make(map[string][]*bets.Bet)
+	for reader != nil {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		bet, err := bets.ParseBet(append([]string{agencyField}, fields...))
+		if err != nil || bets.PrizeOf(bet) == bets.NoPrize {
+			continue
+		}
+		byDocument[bet.Document] = append(byDocument[bet.Document], bet)
+	}
+
+	records := make([]WinnerRecord, 0, len(winners))
+	missing := 0
+	for _, winner := range winners {
+		record := WinnerRecord{Ticket: winner.Ticket, Document: winner.Document}
+		if found := byDocument[winner.Document]; len(found) > 0 {
+			bet := found[0]
+			byDocument[winner.Document] = found[1:]
+			record.FirstName = bet.FirstName
+			record.LastName = bet.LastName
+			record.Number = bet.Number
+			record.Prize = bets.PrizeOf(bet).String()
+		} else {
+			missing++
+		}
+		records = append(records, record)
+	}
+	return records, missing, nil
+}
+
+// WriteJSON Writes the winners file as an indented JSON document
+func (f *WinnersFile) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(f); err != nil {
+		return fmt.Errorf("error encoding winners: %v", err)
+	}
+	return nil
+}
+
+// WriteCSV Writes the winners file as CSV. It has two sections separated
+// by an empty line, each one starting with its own header: the agency with
+// the checksum and the winners
+func (f *WinnersFile) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	records := [][]string{
+		{"agency", "checksum"},
+		{strconv.Itoa(f.Agency), f.Checksum},
+		nil,
+		{"ticket", "first_name", "last_name", "document", "number", "prize"},
+	}
+	for _, winner := range f.Winners {
+		number := ""
+		if winner.Prize != "" {
+			number = strconv.Itoa(winner.Number)
+		}
+		records = append(records, []string{
+			strconv.FormatInt(winner.Ticket, 10),
+			winner.FirstName,
+			winner.LastName,
+			winner.Document,
+			number,
+			winner.Prize,
+		})
+	}
+
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("error writing record: %v", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error writing record: %v", err)
+	}
+	return nil
+}
+
+// WriteWinners Writes the winners of the agency, joined with its bets
+// file, to WinnersPath in WinnersFormat. Does nothing if WinnersPath is
+// empty. If the bets file can't be opened the winners are written without
+// their bets, so they are not lost
+func (c *Client) WriteWinners(results *Results) error {
+	if c.config.WinnersPath == "" {
+		return nil
+	}
+	var reader BetReader
+	agencyFile, err := os.Open(c.config.InputPath)
+	if err != nil {
+		log.Warningf("action: write_winners | result: warning | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+	} else {
+		defer agencyFile.Close()
+		reader, err = NewBetReader(agencyFile, c.config.InputFormat)
+		if err != nil {
+			return err
+		}
+	}
+
+	winners, missing, err := JoinWinners(results.Winners, reader, c.config.ID)
+	if err != nil {
+		return fmt.Errorf("error reading agency file: %v", err)
+	}
+	file := WinnersFile{Agency: c.config.ID, Checksum: results.Checksum, Winners: winners}
+	write := file.WriteCSV
+	if c.config.WinnersFormat == "json" {
+		write = file.WriteJSON
+	}
+	if err := writeFile(c.config.WinnersPath, write); err != nil {
+		return err
+	}
+
+	if missing > 0 {
+		log.Warningf("action: write_winners | result: warning | client_id: %v | file: %v | winners_not_in_file: %v",
+			c.config.ID,
+			c.config.WinnersPath,
+			missing,
+		)
+	}
+	log.Infof("action: write_winners | result: success | client_id: %v | file: %v | winners: %v | checksum: %v",
+		c.config.ID,
+		c.config.WinnersPath,
+		len(winners),
+		results.Checksum,
+	)
+	return nil
+}
+
+func writeFile(path string, write func(io.Writer) error) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinWinnersMatchesWinningBetsByDocument(t *testing.T) {
+	input := "Juan,Perez,30904465,1999-03-17,7574\nAna,Gomez,30904465,2000-01-01,12\nAna,Gomez,30904465,2000-01-01,7574\n"
+	reader, err := NewBetReader(strings.NewReader(input), CSVInput)
+	assert.NoError(t, err)
+	winners := []bets.Winner{{Ticket: 3, Document: "30904465"}, {Ticket: 9, Document: "30904465"}, {Ticket: 12, Document: "1234"}}
+
+	records, missing, err := JoinWinners(winners, reader, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, missing)
+	assert.Equal(t, WinnerRecord{Ticket: 3, FirstName: "Juan", LastName: "Perez", Document: "30904465", Number: 7574, Prize: "first"}, records[0])
+	assert.Equal(t, "Ana", records[1].FirstName)
+	assert.Equal(t, WinnerRecord{Ticket: 12, Document: "1234"}, records[2])
+
+	var output strings.Builder
+	file := WinnersFile{Agency: 1, Checksum: newResults(&shared.ResultsResponseMessage{Winners: winners[:1]}).Checksum, Winners: records}
+	assert.NoError(t, file.WriteCSV(&output))
+	assert.True(t, strings.HasPrefix(output.String(), "agency,checksum\n1,"+file.Checksum+"\n\nticket,"))
+}
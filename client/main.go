@@ -1,71 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/config"
 	"github.com/op/go-logging"
-	"github.com/pkg/errors"
-	"github.com/spf13/viper"
+	"github.com/spf13/pflag"
 )
 
 var log = logging.MustGetLogger("log")
 
-// InitConfig Function that uses viper library to parse configuration parameters.
-// Viper is configured to read variables from both environment variables and the
-// config file ./config.yaml. Environment variables takes precedence over parameters
-// defined in the configuration file. If some of the variables cannot be parsed,
-// an error is returned
-func InitConfig() (*viper.Viper, error) {
-	v := viper.New()
-
-	// Configure viper to read env variables with the CLI_ prefix
-	v.AutomaticEnv()
-	v.SetEnvPrefix("cli")
-	// Use a replacer to replace env variables underscores with points. This let us
-	// use nested configurations in the config file and at the same time define
-	// env variables for the nested configurations
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-
-	// Add env variables supported
-	v.BindEnv("id")
-	v.BindEnv("server", "address")
-	v.BindEnv("loop", "period")
-	v.BindEnv("loop", "amount")
-	v.BindEnv("log", "level")
-	v.BindEnv("nombre")
-	v.BindEnv("apellido")
-	v.BindEnv("documento")
-	v.BindEnv("nacimiento")
-	v.BindEnv("numero")
-	v.BindEnv("batch", "maxAmount")
-
-	v.SetDefault("batch.maxAmount", 105)
-	// Try to read configuration from config file. If config file
-	// does not exists then ReadInConfig will fail but configuration
-	// can be loaded from the environment variables so we shouldn't
-	// return an error in that case
-	v.SetConfigFile("./config.yaml")
-	if err := v.ReadInConfig(); err != nil {
-		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
-	}
-
-	// Parse time.Duration variables and return an error if those variables cannot be parsed
-
-	if _, err := time.ParseDuration(v.GetString("loop.period")); err != nil {
-		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
-	}
-
-	return v, nil
-}
-
 // InitLogger Receives the log level to be set in go-logging as a string. This method
 // parses the string and set the level to the logger. If the level string is not
 // valid an error is returned
@@ -90,81 +45,345 @@ func InitLogger(logLevel string) error {
 
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
-func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s | nombre: %s | apellido: %s | documento: %s | nacimiento: %v | numero: %v | batch_max_amount: %v",
-		v.GetString("id"),
-		v.GetString("server.address"),
-		v.GetInt("loop.amount"),
-		v.GetDuration("loop.period"),
-		v.GetString("log.level"),
-		v.GetString("nombre"),
-		v.GetString("apellido"),
-		v.GetString("documento"),
-		v.GetTime("nacimiento"),
-		v.GetInt("numero"),
-		v.GetInt("batch.maxAmount"),
+func PrintConfig(cfg *config.Client) {
+	log.Infof("action: config | result: success | command: %v | client_id: %v | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s | nombre: %s | apellido: %s | documento: %s | nacimiento: %v | numero: %v | batch_max_amount: %v | batch_max_bytes: %v | batch_window: %v | input_path: %v | input_format: %v | rejects_path: %v | dry_run: %v | agencies: %v | max_connections: %v | checksum: %v | compression: %v | compression_threshold: %v | heartbeat_interval: %v | heartbeat_misses: %v | progress_interval: %v | summary_path: %v | results_timeout: %v | results_path: %v | results_format: %v",
+		cfg.Command,
+		cfg.ID,
+		cfg.ServerAddress,
+		cfg.LoopAmount,
+		cfg.LoopPeriod,
+		cfg.LogLevel,
+		cfg.FirstName,
+		cfg.LastName,
+		cfg.Document,
+		cfg.BirthDate,
+		cfg.Number,
+		cfg.BatchMaxAmount,
+		cfg.BatchMaxBytes,
+		cfg.BatchWindow,
+		cfg.InputPath,
+		cfg.InputFormat,
+		cfg.RejectsPath,
+		cfg.DryRun,
+		cfg.Agencies,
+		cfg.MaxConnections,
+		cfg.Checksum,
+		cfg.Compression,
+		cfg.CompressionThreshold,
+		cfg.HeartbeatInterval,
+		cfg.HeartbeatMisses,
+		cfg.ProgressInterval,
+		cfg.SummaryPath,
+		cfg.ResultsTimeout,
+		cfg.WinnersPath,
+		cfg.WinnersFormat,
 	)
 }
 
-func gracefulShutdown(c *common.Client, finished chan bool, wg *sync.WaitGroup) {
-	defer wg.Done()
+// Exit codes of the client
+const (
+	exitOk = 0
+	// exitFailure Any other error, like an agency file that can't be read
+	exitFailure = 1
+	// exitConfig The configuration could not be loaded or is invalid
+	exitConfig = 2
+	// exitUnreachable The server could not be reached
+	exitUnreachable = 3
+	// exitRejected Some bets were rejected or skipped
+	exitRejected = 4
+	// exitResultsUnavailable The draw did not close before results.timeout
+	exitResultsUnavailable = 5
+	// exitInterrupted The client was stopped by a signal. The exit code is
+	// exitInterrupted plus the signal number, 143 for SIGTERM
+	exitInterrupted = 128
+)
+
+// notifyContext Returns a copy of parent that is canceled when the process
+// gets SIGTERM or SIGINT, along with a function that returns the signal
+// received, nil if none, and one that stops listening for them
+func notifyContext(parent context.Context) (context.Context, func() os.Signal, func()) {
+	ctx, cancel := context.WithCancel(parent)
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGTERM)
-	var reason string
-	select {
-	case s := <-quit:
-		reason = s.String()
-	case <-finished:
-		reason = "client finished"
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+
+	var mutex sync.Mutex
+	var received os.Signal
+	go func() {
+		select {
+		case <-ctx.Done():
+		case got := <-quit:
+			log.Infof("action: graceful_shutdown | result: in_progress | reason: %s", got)
+			mutex.Lock()
+			received = got
+			mutex.Unlock()
+			cancel()
+		}
+	}()
+	return ctx,
+		func() os.Signal {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return received
+		},
+		func() {
+			signal.Stop(quit)
+			cancel()
+		}
+}
+
+// exitCode Exit code for the results of the agencies. When they ended
+// differently an unreachable server comes first, then any other error,
+// then rejected bets and last results that were not available
+func exitCode(results []agencyResult, summaries []common.UploadSummary) int {
+	var unreachable, failed, rejected, unavailable bool
+	for i, result := range results {
+		switch {
+		case errors.Is(result.err, common.ErrServerUnreachable):
+			unreachable = true
+		case errors.Is(result.err, common.ErrResultsUnavailable):
+			unavailable = true
+		case result.err != nil:
+			failed = true
+		}
+		if !summaries[i].AllAccepted() {
+			rejected = true
+		}
+	}
+	switch {
+	case unreachable:
+		return exitUnreachable
+	case failed:
+		return exitFailure
+	case rejected:
+		return exitRejected
+	case unavailable:
+		return exitResultsUnavailable
+	}
+	return exitOk
+}
+
+// agencyResult What the command ended with for an agency
+type agencyResult struct {
+	agency  int
+	results *common.Results
+	status  *shared.StatusMessage
+	err     error
+}
+
+// runCommand Runs the command for every client at once. Results come in
+// the order of the clients
+func runCommand(ctx context.Context, command string, clients []*common.Client, agencies []config.Agency) []agencyResult {
+	results := make([]agencyResult, len(clients))
+	wg := sync.WaitGroup{}
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *common.Client) {
+			defer wg.Done()
+			results[i] = runAgencyCommand(ctx, command, client, agencies[i])
+		}(i, client)
+	}
+	wg.Wait()
+	return results
+}
+
+// runAgencyCommand Runs the command for a single agency. all uploads its
+// bets, tells the server it is done and asks for its winners, the other
+// commands run just one of those steps or ask for its status
+func runAgencyCommand(ctx context.Context, command string, client *common.Client, agency config.Agency) agencyResult {
+	result := agencyResult{agency: agency.ID}
+	if command == "all" || command == "upload" {
+		log.Infof("action: agency_upload | result: in_progress | client_id: %v | file: %v", agency.ID, agency.InputPath)
+		upload := client.UploadBets
+		if command == "all" {
+			upload = client.SendBatches
+		}
+		if err := upload(ctx); err != nil {
+			log.Errorf("action: agency_upload | result: fail | client_id: %v | error: %v", agency.ID, err)
+			result.err = err
+			return result
+		}
+		log.Infof("action: agency_upload | result: success | client_id: %v", agency.ID)
+	}
+
+	switch command {
+	case "finish":
+		result.err = client.SendAllBetsSent(ctx)
+	case "all", "results":
+		result.results, result.err = client.SendResultsQuery(ctx)
+		if result.err == nil {
+			result.err = client.WriteWinners(result.results)
+		}
+	case "status":
+		result.status, result.err = client.QueryStatus(ctx)
+	}
+	return result
+}
+
+// printResults Prints what the results and status commands got for each
+// agency. The other commands have nothing to print
+func printResults(command string, results []agencyResult) {
+	if command != "results" && command != "status" {
+		return
+	}
+	for _, result := range results {
+		if result.err != nil {
+			continue
+		}
+		if len(results) > 1 {
+			fmt.Printf("agency: %v\n", result.agency)
+		}
+		switch command {
+		case "results":
+			fmt.Printf("winners: %v\n", len(result.results.Winners))
+			fmt.Printf("checksum: %v\n", result.results.Checksum)
+			for _, winner := range result.results.Winners {
+				fmt.Printf("winner: %v %v\n", winner.Ticket, winner.Document)
+			}
+		case "status":
+			fmt.Printf("bets: %v\n", result.status.BetsCommitted)
+			fmt.Printf("finished: %v\n", result.status.Finished)
+			fmt.Printf("draw_closed: %v\n", result.status.DrawClosed)
+			fmt.Printf("finished_agencies: %v/%v\n", result.status.FinishedAgencies, result.status.TotalAgencies)
+		}
 	}
+}
 
-	log.Infof("action: graceful_shutdown | result: success | reason: %s", reason)
-	c.Cleanup(reason)
+// agencyFilePath Rejects or winners file of an agency. When several
+// agencies are uploaded at once each one gets its own, named after the
+// agency
+func agencyFilePath(path string, agency int, agencies int) string {
+	if path == "" || agencies == 1 {
+		return path
+	}
+	extension := filepath.Ext(path)
+	return fmt.Sprintf("%v-%v%v", strings.TrimSuffix(path, extension), agency, extension)
 }
+
 func main() {
-	v, err := InitConfig()
+	os.Exit(run())
+}
+
+// run Runs the client and returns its exit code
+func run() int {
+	cfg, mode, err := config.LoadClient(os.Args[1:])
+	if errors.Is(err, pflag.ErrHelp) {
+		return exitOk
+	}
+	if mode == config.PrintMode && cfg != nil {
+		cfg.Print(os.Stdout)
+	}
 	if err != nil {
-		log.Criticalf("%s", err)
+		fmt.Fprintf(os.Stderr, "error initializing config: %v\n", err)
+		return exitConfig
+	}
+	if mode == config.CheckMode {
+		fmt.Println("configuration is valid")
+	}
+	if mode != config.RunMode {
+		return exitOk
 	}
 
-	if err := InitLogger(v.GetString("log.level")); err != nil {
-		log.Criticalf("%s", err)
+	if err := InitLogger(cfg.LogLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "error initializing logger: %v\n", err)
+		return exitConfig
 	}
 
 	// Print program config with debugging purposes
-	PrintConfig(v)
+	PrintConfig(cfg)
 
-	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetInt("id"),
-		LoopAmount:    v.GetInt("loop.amount"),
-		LoopPeriod:    v.GetDuration("loop.period"),
-		MaxAmount:     v.GetInt("batch.maxAmount"),
+	agencies := cfg.Agencies
+	if len(agencies) == 0 {
+		agencies = []config.Agency{{ID: cfg.ID, InputPath: cfg.InputPath}}
 	}
 
 	bet := bets.Bet{
-		FirstName: v.GetString("nombre"),
-		LastName:  v.GetString("apellido"),
-		Document:  v.GetString("documento"),
-		BirthDate: v.GetTime("nacimiento"),
-		Number:    v.GetInt("numero"),
+		FirstName: cfg.FirstName,
+		LastName:  cfg.LastName,
+		Document:  cfg.Document,
+		BirthDate: cfg.BirthDate,
+		Number:    cfg.Number,
 	}
 
-	client := common.NewClient(clientConfig, bet)
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-
-	finished := make(chan bool)
-	go gracefulShutdown(client, finished, &wg)
+	budget := common.NewConnectionBudget(cfg.MaxConnections)
+	clients := make([]*common.Client, 0, len(agencies))
+	for _, agency := range agencies {
+		clientConfig := common.ClientConfig{
+			ServerAddress:        cfg.ServerAddress,
+			ID:                   agency.ID,
+			LoopAmount:           cfg.LoopAmount,
+			LoopPeriod:           cfg.LoopPeriod,
+			MaxAmount:            cfg.BatchMaxAmount,
+			MaxBytes:             cfg.BatchMaxBytes,
+			Window:               cfg.BatchWindow,
+			Checksum:             cfg.Checksum,
+			Compression:          cfg.Compression,
+			CompressionThreshold: cfg.CompressionThreshold,
+			HeartbeatInterval:    cfg.HeartbeatInterval,
+			HeartbeatMisses:      cfg.HeartbeatMisses,
+			ProgressInterval:     cfg.ProgressInterval,
+			ResultsTimeout:       cfg.ResultsTimeout,
+			InputPath:            agency.InputPath,
+			InputFormat:          cfg.InputFormat,
+			RejectsPath:          agencyFilePath(cfg.RejectsPath, agency.ID, len(agencies)),
+			WinnersPath:          agencyFilePath(cfg.WinnersPath, agency.ID, len(agencies)),
+			WinnersFormat:        cfg.WinnersFormat,
+		}
+		client := common.NewClient(clientConfig, bet)
+		client.SetConnectionBudget(budget)
+		clients = append(clients, client)
+	}
 
-	client.SendBatches()
+	if cfg.DryRun {
+		for i, client := range clients {
+			summary, err := client.DryRun()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error validating bets of agency %v: %v\n", agencies[i].ID, err)
+				return exitFailure
+			}
+			if len(clients) > 1 {
+				fmt.Printf("agency: %v\n", agencies[i].ID)
+			}
+			summary.Print(os.Stdout)
+		}
+		return exitOk
+	}
 
-	client.SendResultsQuery()
+	// SIGTERM or SIGINT cancel ctx, which stops every agency
+	ctx, receivedSignal, stop := notifyContext(context.Background())
+	defer stop()
+	results := runCommand(ctx, cfg.Command, clients, agencies)
+	if received := receivedSignal(); received != nil {
+		log.Infof("action: graceful_shutdown | result: success | reason: %s", received)
+		if signalNumber, ok := received.(syscall.Signal); ok {
+			return exitInterrupted + int(signalNumber)
+		}
+		return exitInterrupted
+	}
 
-	if !client.Shutdown {
-		finished <- true
+	summaries := make([]common.UploadSummary, 0, len(clients))
+	for _, client := range clients {
+		summaries = append(summaries, client.UploadProgress())
+	}
+	uploaded := cfg.Command == "all" || cfg.Command == "upload"
+	if uploaded && cfg.SummaryPath != "" {
+		if err := common.WriteSummaries(cfg.SummaryPath, summaries); err != nil {
+			log.Errorf("action: write_summary | result: fail | file: %v | error: %v", cfg.SummaryPath, err)
+		}
+	}
+	for _, result := range results {
+		if result.err != nil {
+			log.Errorf("action: agency_results | result: fail | client_id: %v | command: %v | error: %v", result.agency, cfg.Command, result.err)
+			continue
+		}
+		if cfg.Command == "all" || cfg.Command == "results" {
+			log.Infof("action: agency_results | result: success | client_id: %v | cant_ganadores: %v", result.agency, len(result.results.Winners))
+		}
 	}
+	printResults(cfg.Command, results)
 
-	wg.Wait()
-	time.Sleep(500 * time.Millisecond)
+	for _, client := range clients {
+		client.Cleanup("client finished")
+	}
+	log.Infof("action: graceful_shutdown | result: success | reason: client finished")
+	return exitCode(results, summaries)
 }
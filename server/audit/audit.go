@@ -0,0 +1,194 @@
+// Package audit keeps an append-only trail of every draw event. Each entry
+// holds the hash of the previous one, so editing, removing or reordering
+// entries after the fact breaks the chain, and accepted bets carry a digest
+// of their stored record, so edits to the bets storage are detectable too.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+const AUDIT_FILEPATH = "./audit.log"
+
+// Event Kind of an audit entry
+type Event string
+
+const (
+	BetAccepted  Event = "bet_accepted"
+	BetRejected  Event = "bet_rejected"
+	BetCancelled Event = "bet_cancelled"
+	AllBetsSent  Event = "all_bets_sent"
+	ResultsQuery Event = "results_query"
+	DrawClosed   Event = "draw_closed"
+)
+
+// genesisHash Previous hash of the first entry
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Entry One line of the audit log. Sequence, Time, PrevHash and Hash are
+// filled by Log.Append
+type Entry struct {
+	Sequence int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Event    Event     `json:"event"`
+	Agency   int       `json:"agency,omitempty"`
+	Ticket   int64     `json:"ticket,omitempty"`
+	Digest   string    `json:"digest,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// computeHash Hash of the entry with its Hash field empty
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return shared.Digest(data), nil
+}
+
+// BetDigest Digest of everything stored for a bet
+func BetDigest(bet *bets.Bet) string {
+	return shared.Digest([]byte(fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v",
+		bet.Ticket,
+		bet.Agency,
+		bet.FirstName,
+		bet.LastName,
+		bet.Document,
+		bet.BirthDate.Format("2006-01-02"),
+		bet.Number,
+	)))
+}
+
+// BetAcceptedEntry Entry recording that the bet was stored
+func BetAcceptedEntry(bet *bets.Bet) Entry {
+	return Entry{Event: BetAccepted, Agency: bet.Agency, Ticket: bet.Ticket, Digest: BetDigest(bet)}
+}
+
+// BetCancelledEntry Entry recording the tombstone of a bet
+func BetCancelledEntry(cancellation bets.Cancellation) Entry {
+	entry := Entry{Event: BetCancelled, Agency: cancellation.Agency, Ticket: cancellation.Ticket}
+	if cancellation.ReplacedBy != 0 {
+		entry.Detail = "replaced_by=" + strconv.FormatInt(cancellation.ReplacedBy, 10)
+	}
+	return entry
+}
+
+// Log Append-only, hash-chained audit log. It is safe for concurrent use
+type Log struct {
+	mutex    sync.Mutex
+	file     *os.File
+	sequence int64
+	lastHash string
+}
+
+// Open Opens the audit log at path, creating it if needed, and continues
+// the chain from its last entry
+func Open(path string) (*Log, error) {
+	auditLog := &Log{lastHash: genesisHash}
+	err := forEachEntry(path, func(entry Entry) error {
+		auditLog.sequence = entry.Sequence
+		auditLog.lastHash = entry.Hash
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	auditLog.file = file
+	return auditLog, nil
+}
+
+// Append Chains the entries to the log and writes them with a single write
+func (l *Log) Append(entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now().UTC()
+	sequence := l.sequence
+	lastHash := l.lastHash
+	var buffer []byte
+	for _, entry := range entries {
+		sequence++
+		entry.Sequence = sequence
+		entry.Time = now
+		entry.PrevHash = lastHash
+		hash, err := entry.computeHash()
+		if err != nil {
+			return fmt.Errorf("error hashing audit entry: %v", err)
+		}
+		entry.Hash = hash
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error encoding audit entry: %v", err)
+		}
+		buffer = append(buffer, line...)
+		buffer = append(buffer, '\n')
+		lastHash = hash
+	}
+
+	if _, err := l.file.Write(buffer); err != nil {
+		return fmt.Errorf("error writing audit entries: %v", err)
+	}
+	l.sequence = sequence
+	l.lastHash = lastHash
+	return nil
+}
+
+// Close Syncs and closes the underlying file
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return fmt.Errorf("error syncing audit log: %v", err)
+	}
+	return l.file.Close()
+}
+
+// forEachEntry Calls fn for every entry in the log at path, in order. The
+// error of a missing file satisfies os.IsNotExist
+func forEachEntry(path string, fn func(Entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("error decoding audit entry at line %v: %v", line, err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading audit log: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendAll(t *testing.T, path string, entries ...Entry) {
+	auditLog, err := Open(path)
+	assert.NoError(t, err)
+	assert.NoError(t, auditLog.Append(entries...))
+	assert.NoError(t, auditLog.Close())
+}
+
+func TestOpenContinuesTheChainOfAnExistingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	appendAll(t, path, Entry{Event: AllBetsSent, Agency: 1})
+	appendAll(t, path, Entry{Event: AllBetsSent, Agency: 2}, Entry{Event: ResultsQuery, Agency: 1})
+
+	var entries []Entry
+	err := forEachEntry(path, func(entry Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, genesisHash, entries[0].PrevHash)
+	for i, entry := range entries {
+		assert.Equal(t, int64(i+1), entry.Sequence)
+		if i > 0 {
+			assert.Equal(t, entries[i-1].Hash, entry.PrevHash)
+		}
+	}
+}
+
+func TestEditedEntryBreaksTheChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	appendAll(t, path, Entry{Event: AllBetsSent, Agency: 1}, Entry{Event: AllBetsSent, Agency: 2})
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	tampered := strings.Replace(string(data), `"agency":2`, `"agency":3`, 1)
+	assert.NoError(t, os.WriteFile(path, []byte(tampered), 0644))
+
+	report, err := Verify(path)
+	assert.NoError(t, err)
+	assert.False(t, report.Ok())
+	assert.Contains(t, report.Problems, "entry 2: hash does not match its content")
+}
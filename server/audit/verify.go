@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+// Report Outcome of verifying an audit log
+type Report struct {
+	Entries  int64
+	Bets     int64
+	Problems []string
+}
+
+// Ok Tells whether no problem was found
+func (r *Report) Ok() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) addProblem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Verify Walks the hash chain of the audit log at path and cross-checks it
+// against the bets storage, its tombstones and the draw state. Problems
+// found are listed in the report; an error is only returned if something
+// can't be read at all
+func Verify(path string) (*Report, error) {
+	report := &Report{}
+	accepted := make(map[int64]string)
+	cancelled := make(map[int64]bool)
+	// winnersDigest Digest of the winners when the draw closed, empty while
+	// it's open
+	winnersDigest := ""
+
+	lastHash := genesisHash
+	err := forEachEntry(path, func(entry Entry) error {
+		report.Entries++
+		if entry.Sequence != report.Entries {
+			report.addProblem("entry %v: expected sequence %v", entry.Sequence, report.Entries)
+		}
+		if entry.PrevHash != lastHash {
+			report.addProblem("entry %v: chain broken, previous hash does not match", entry.Sequence)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != entry.Hash {
+			report.addProblem("entry %v: hash does not match its content", entry.Sequence)
+		}
+		lastHash = entry.Hash
+
+		switch entry.Event {
+		case BetAccepted:
+			if _, ok := accepted[entry.Ticket]; ok {
+				report.addProblem("entry %v: ticket %v accepted twice", entry.Sequence, entry.Ticket)
+			}
+			accepted[entry.Ticket] = entry.Digest
+		case BetCancelled:
+			cancelled[entry.Ticket] = true
+		case DrawClosed:
+			if winnersDigest != "" {
+				report.addProblem("entry %v: draw closed twice", entry.Sequence)
+			}
+			winnersDigest = entry.Digest
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading audit log: %v", err)
+	}
+
+	err = bets.ForEachRecord(func(bet *bets.Bet) error {
+		report.Bets++
+		digest, ok := accepted[bet.Ticket]
+		if !ok {
+			report.addProblem("ticket %v: stored but never accepted", bet.Ticket)
+			return nil
+		}
+		if digest != BetDigest(bet) {
+			report.addProblem("ticket %v: stored record does not match the accepted bet", bet.Ticket)
+		}
+		delete(accepted, bet.Ticket)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading bets: %v", err)
+	}
+	missing := make([]int64, 0, len(accepted))
+	for ticket := range accepted {
+		missing = append(missing, ticket)
+	}
+	for _, ticket := range sortTickets(missing) {
+		report.addProblem("ticket %v: accepted but missing from storage", ticket)
+	}
+
+	cancellations, err := bets.LoadCancellations()
+	if err != nil {
+		return nil, fmt.Errorf("error reading cancelled bets: %v", err)
+	}
+	stored := make([]int64, 0, len(cancellations))
+	for ticket := range cancellations {
+		stored = append(stored, ticket)
+	}
+	for _, ticket := range sortTickets(stored) {
+		if !cancelled[ticket] {
+			report.addProblem("ticket %v: cancelled in storage but not in the audit log", ticket)
+		}
+	}
+	logged := make([]int64, 0, len(cancelled))
+	for ticket := range cancelled {
+		logged = append(logged, ticket)
+	}
+	for _, ticket := range sortTickets(logged) {
+		if _, ok := cancellations[ticket]; !ok {
+			report.addProblem("ticket %v: cancelled in the audit log but not in storage", ticket)
+		}
+	}
+
+	state, err := bets.LoadDrawState()
+	if err != nil {
+		return nil, fmt.Errorf("error reading draw state: %v", err)
+	}
+	switch {
+	case state.Closed && winnersDigest == "":
+		report.addProblem("draw: closed in storage but not in the audit log")
+	case !state.Closed && winnersDigest != "":
+		report.addProblem("draw: closed in the audit log but not in storage")
+	case state.Closed:
+		winnersJSON, err := json.Marshal(state.Winners)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding winners: %v", err)
+		}
+		if shared.Digest(winnersJSON) != winnersDigest {
+			report.addProblem("draw: stored winners do not match the closed draw")
+		}
+	}
+
+	return report, nil
+}
+
+// sortTickets Sorts the tickets in ascending order so problems are always
+// reported in the same order
+func sortTickets(tickets []int64) []int64 {
+	sort.Slice(tickets, func(i, j int) bool { return tickets[i] < tickets[j] })
+	return tickets
+}
@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeClosedDraw Stores three bets of agency 1 in the working directory,
+// cancels the third one and closes the draw with the first one as winner,
+// recording all of it in the audit log as the server does
+func storeClosedDraw(t *testing.T) {
+	var stored []*bets.Bet
+	for i, document := range []string{"30000001", "30000002", "30000003"} {
+		bet, err := bets.NewBet("1", "first", "last", document, "2000-12-20", bets.LOTTERY_WINNER_NUMBER)
+		assert.NoError(t, err)
+		bet.Ticket = int64(i + 1)
+		stored = append(stored, bet)
+	}
+	assert.NoError(t, bets.StoreBets(stored))
+	cancellation := bets.Cancellation{Ticket: 3, Agency: 1}
+	assert.NoError(t, bets.StoreCancellation(cancellation))
+	winners := map[int][]bets.Winner{1: {{Ticket: 1, Document: "30000001"}, {Ticket: 2, Document: "30000002"}}}
+	assert.NoError(t, bets.StoreDrawState(bets.NewDrawState(map[int]bool{1: true}, winners)))
+
+	winnersJSON, err := json.Marshal(winners)
+	assert.NoError(t, err)
+	appendAll(t, AUDIT_FILEPATH,
+		BetAcceptedEntry(stored[0]),
+		BetAcceptedEntry(stored[1]),
+		BetAcceptedEntry(stored[2]),
+		BetCancelledEntry(cancellation),
+		Entry{Event: AllBetsSent, Agency: 1},
+		Entry{Event: DrawClosed, Digest: shared.Digest(winnersJSON)},
+	)
+}
+
+func TestVerifyCrossChecksTheLogWithTheStoredBetsAndDraw(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T)
+		// problems Problems expected, none meaning the log is consistent
+		problems []string
+	}{
+		{name: "storage matches", tamper: func(t *testing.T) {}},
+		{
+			name: "stored bet edited",
+			tamper: func(t *testing.T) {
+				data, err := os.ReadFile(bets.STORAGE_FILEPATH)
+				assert.NoError(t, err)
+				tampered := strings.Replace(string(data), "30000002", "30000009", 1)
+				assert.NoError(t, os.WriteFile(bets.STORAGE_FILEPATH, []byte(tampered), 0644))
+			},
+			problems: []string{"ticket 2: stored record does not match the accepted bet"},
+		},
+		{
+			name: "stored winners edited",
+			tamper: func(t *testing.T) {
+				winners := map[int][]bets.Winner{1: {{Ticket: 2, Document: "30000002"}}}
+				assert.NoError(t, bets.StoreDrawState(bets.NewDrawState(map[int]bool{1: true}, winners)))
+			},
+			problems: []string{"draw: stored winners do not match the closed draw"},
+		},
+		{
+			name: "draw reopened in storage",
+			tamper: func(t *testing.T) {
+				assert.NoError(t, bets.StoreDrawState(bets.NewDrawState(map[int]bool{1: true}, nil)))
+			},
+			problems: []string{"draw: closed in the audit log but not in storage"},
+		},
+		{
+			name: "cancellation removed from storage",
+			tamper: func(t *testing.T) {
+				assert.NoError(t, os.Remove(bets.CANCELLATIONS_FILEPATH))
+			},
+			problems: []string{"ticket 3: cancelled in the audit log but not in storage"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := os.Getwd()
+			assert.NoError(t, err)
+			assert.NoError(t, os.Chdir(t.TempDir()))
+			defer os.Chdir(dir)
+			storeClosedDraw(t)
+
+			test.tamper(t)
+
+			report, err := Verify(AUDIT_FILEPATH)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(6), report.Entries)
+			assert.Equal(t, int64(3), report.Bets)
+			assert.Equal(t, test.problems, report.Problems)
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package bets
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,6 +16,9 @@ const STORAGE_FILEPATH = "./bets.csv"
 const LOTTERY_WINNER_NUMBER = 7574
 
 type Bet struct {
+	// Ticket Unique, monotonic identifier the server assigns to the bet when
+	// it is stored. 0 means the bet has no ticket yet
+	Ticket    int64
 	Agency    int
 	FirstName string
 	LastName  string
@@ -20,6 +27,10 @@ type Bet struct {
 	Number    int
 }
 
+// BATCH_SEPARATORS Characters that separate the fields and the bets of a
+// batch, which the fields of a bet can't contain
+const BATCH_SEPARATORS = ";\n\r"
+
 func NewBet(agencyStr string, firstName string, lastName string, document string, birthDateStr string, number int) (*Bet, error) {
 	agency, err := strconv.Atoi(agencyStr)
 	if err != nil {
@@ -40,39 +51,204 @@ func NewBet(agencyStr string, firstName string, lastName string, document string
 	}, nil
 }
 
+// ParseBet Builds a bet from its fields as they travel in a batch: agency,
+// first name, last name, document, birth date and number. Both the server
+// and the agencies' pre-validation use it, so they accept the same bets.
+// Fields can't contain the separators of fields and bets in a batch
+func ParseBet(fields []string) (*Bet, error) {
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expected 6 fields, got %v", len(fields))
+	}
+	for i, field := range fields {
+		if strings.ContainsAny(field, BATCH_SEPARATORS) {
+			return nil, fmt.Errorf("field %v contains a batch separator: %q", i+1, field)
+		}
+	}
+	number, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("error converting number to int: %v", err)
+	}
+	return NewBet(fields[0], fields[1], fields[2], fields[3], fields[4], number)
+}
+
 func HasWon(bet *Bet) bool {
 	return bet.Number == LOTTERY_WINNER_NUMBER
 }
 
+// Prize Prize tier a bet is entitled to once the draw is closed
+type Prize int
+
+const (
+	NoPrize Prize = iota
+	FirstPrize
+)
+
+var prizeNames = map[Prize]string{
+	NoPrize:    "none",
+	FirstPrize: "first",
+}
+
+func (p Prize) String() string {
+	if name, ok := prizeNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("prize(%d)", int(p))
+}
+
+// ParsePrize Inverse of Prize.String
+func ParsePrize(name string) (Prize, error) {
+	for prize, prizeName := range prizeNames {
+		if prizeName == name {
+			return prize, nil
+		}
+	}
+	return NoPrize, fmt.Errorf("unknown prize tier %q", name)
+}
+
+// PrizeOf Returns the prize tier the bet won
+func PrizeOf(bet *Bet) Prize {
+	if HasWon(bet) {
+		return FirstPrize
+	}
+	return NoPrize
+}
+
+// StoreBets Appends the bets to the storage, one record per bet with the
+// ticket as the last field. Bets without a ticket are stored in the legacy
+// six-field format
 func StoreBets(bets []*Bet) error {
+	_, err := AppendBets(bets)
+	return err
+}
+
+// AppendBets Same as StoreBets, but also returns the offset in the storage
+// of the record of each bet, which ReadBet reads it back from. Must not be
+// called concurrently, the offsets are counted from the size of the storage
+// before writing
+func AppendBets(bets []*Bet) ([]int64, error) {
 	file, err := os.OpenFile(STORAGE_FILEPATH, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
+		return nil, fmt.Errorf("error opening file: %v", err)
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage size: %v", err)
+	}
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	offsets := make([]int64, 0, len(bets))
 	for _, bet := range bets {
-		record := []string{
-			strconv.Itoa(bet.Agency),
-			bet.FirstName,
-			bet.LastName,
-			bet.Document,
-			bet.BirthDate.Format("2006-01-02"),
-			strconv.Itoa(bet.Number),
+		offsets = append(offsets, info.Size()+int64(buffer.Len()))
+		if err := writer.Write(betRecord(bet)); err != nil {
+			return nil, fmt.Errorf("error writing record: %v", err)
 		}
-		if err := writer.Write(record); err != nil {
-			return fmt.Errorf("error writing record: %v", err)
+		writer.Flush()
+	}
+	if err := writer.Error(); err != nil {
+		return nil, fmt.Errorf("error writing record: %v", err)
+	}
+	if _, err := file.Write(buffer.Bytes()); err != nil {
+		return nil, fmt.Errorf("error writing record: %v", err)
+	}
+	return offsets, nil
+}
+
+// ReadBet Reads the bet whose record starts at offset in the storage, as
+// returned by AppendBets or ForEachWithOffset. Records in the legacy
+// six-field format don't carry their ticket, so it is given
+func ReadBet(offset int64, ticket int64) (*Bet, error) {
+	file, err := os.Open(STORAGE_FILEPATH)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error seeking record: %v", err)
+	}
+
+	records := newRecordReader(file, offset)
+	record, _, err := records.next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("error reading record: no record at offset %v", offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return betFromRecord(record, ticket)
+}
+
+// SyncStorage Makes sure the stored bets and their cancellations reach the
+// disk. Storage files that don't exist yet are skipped
+func SyncStorage() error {
+	for _, path := range []string{STORAGE_FILEPATH, CANCELLATIONS_FILEPATH} {
+		if err := syncFile(path); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("error syncing %v: %v", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
 	return nil
 }
 
+// LoadBets Reads every stored bet that was not cancelled into memory.
+// Prefer ForEach when the bets only need to be visited once
 func LoadBets() ([]*Bet, error) {
-	file, err := os.Open(STORAGE_FILEPATH)
+	cancellations, err := LoadCancellations()
+	if err != nil {
+		return nil, err
+	}
+	return loadBetsFrom(STORAGE_FILEPATH, cancellations)
+}
+
+// ForEach Calls fn for every stored bet that was not cancelled, in storage
+// order. The file is read one record at a time so memory use doesn't depend
+// on the amount of bets. Iteration stops at the first error, which is
+// returned. If no bet was stored yet there is nothing to visit and no error
+// is returned
+func ForEach(fn func(*Bet) error) error {
+	cancellations, err := LoadCancellations()
+	if err != nil {
+		return err
+	}
+	return forEachIn(STORAGE_FILEPATH, cancellations, fn)
+}
+
+// ForEachRecord Same as ForEach but also visits the bets that were
+// cancelled, which are still kept in the storage
+func ForEachRecord(fn func(*Bet) error) error {
+	return forEachIn(STORAGE_FILEPATH, nil, fn)
+}
+
+// ForEachWithOffset Same as ForEach, but also passes the offset in the
+// storage of the record of each bet, which ReadBet reads it back from
+func ForEachWithOffset(fn func(bet *Bet, offset int64) error) error {
+	cancellations, err := LoadCancellations()
+	if err != nil {
+		return err
+	}
+	return forEachWithOffsetIn(STORAGE_FILEPATH, cancellations, fn)
+}
+
+func loadBetsFrom(path string, cancellations map[int64]Cancellation) ([]*Bet, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("error opening file: %v", err)
 	}
@@ -87,24 +263,155 @@ func LoadBets() ([]*Bet, error) {
 	}
 
 	bets := make([]*Bet, 0, len(records))
-	for _, record := range records {
-		number, err := strconv.Atoi(record[5])
+	for i, record := range records {
+		bet, err := betFromRecord(record, int64(i+1))
 		if err != nil {
-			return nil, fmt.Errorf("error converting number to int: %v", err)
+			return nil, err
 		}
-
-		bet, err := NewBet(
-			record[0],
-			record[1],
-			record[2],
-			record[3],
-			record[4],
-			number,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("error creating bet: %v", err)
+		if _, cancelled := cancellations[bet.Ticket]; cancelled {
+			continue
 		}
 		bets = append(bets, bet)
 	}
 	return bets, nil
 }
+
+func forEachIn(path string, cancellations map[int64]Cancellation, fn func(*Bet) error) error {
+	return forEachWithOffsetIn(path, cancellations, func(bet *Bet, _ int64) error {
+		return fn(bet)
+	})
+}
+
+func forEachWithOffsetIn(path string, cancellations map[int64]Cancellation, fn func(*Bet, int64) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	records := newRecordReader(file, 0)
+	for position := int64(1); ; position++ {
+		record, offset, err := records.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		bet, err := betFromRecord(record, position)
+		if err != nil {
+			return err
+		}
+		if _, cancelled := cancellations[bet.Ticket]; cancelled {
+			continue
+		}
+		if err := fn(bet, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// recordReader Reads the storage one record at a time, keeping track of the
+// offset each one starts at so it can be read again on its own
+type recordReader struct {
+	reader *bufio.Reader
+	offset int64
+}
+
+// newRecordReader Returns a reader of the records of r, which is at offset
+// of the storage
+func newRecordReader(r io.Reader, offset int64) *recordReader {
+	return &recordReader{reader: bufio.NewReader(r), offset: offset}
+}
+
+// next Returns the next record and its offset, or io.EOF once there are no
+// more. A record spans several lines when a quoted field has line breaks,
+// which is when the quotes read so far are unbalanced. Empty lines are
+// skipped, like encoding/csv does
+func (r *recordReader) next() ([]string, int64, error) {
+	for {
+		start := r.offset
+		var text string
+		for {
+			line, err := r.reader.ReadString('\n')
+			r.offset += int64(len(line))
+			text += line
+			if err == io.EOF {
+				if text == "" {
+					return nil, start, io.EOF
+				}
+				break
+			}
+			if err != nil {
+				return nil, start, fmt.Errorf("error reading record: %v", err)
+			}
+			if strings.Count(text, `"`)%2 == 0 {
+				break
+			}
+		}
+		if strings.TrimRight(text, "\r\n") == "" {
+			continue
+		}
+		record, err := parseRecord(text)
+		return record, start, err
+	}
+}
+
+// parseRecord Parses the text of one record with the settings the storage
+// is read with. Records without quotes, almost all of them, are split
+// directly
+func parseRecord(text string) ([]string, error) {
+	if !strings.Contains(text, `"`) {
+		fields := strings.Split(strings.TrimRight(text, "\r\n"), ",")
+		for i, field := range fields {
+			fields[i] = strings.TrimLeft(field, " \t")
+		}
+		return fields, nil
+	}
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	record, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading record: %v", err)
+	}
+	return record, nil
+}
+
+// betFromRecord Parses a storage record. Records written before tickets
+// were persisted have six fields, their ticket is their 1-based position in
+// the storage, which is the ticket the server handed out for them
+func betFromRecord(record []string, position int64) (*Bet, error) {
+	if len(record) != 6 && len(record) != 7 {
+		return nil, fmt.Errorf("error reading record: expected 6 or 7 fields, got %v", len(record))
+	}
+	number, err := strconv.Atoi(record[5])
+	if err != nil {
+		return nil, fmt.Errorf("error converting number to int: %v", err)
+	}
+
+	bet, err := NewBet(
+		record[0],
+		record[1],
+		record[2],
+		record[3],
+		record[4],
+		number,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating bet: %v", err)
+	}
+
+	bet.Ticket = position
+	if len(record) == 7 {
+		bet.Ticket, err = strconv.ParseInt(record[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error converting ticket to int: %v", err)
+		}
+	}
+	return bet, nil
+}
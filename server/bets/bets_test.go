@@ -1,7 +1,11 @@
 package bets
 
 import (
+	"bufio"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -30,6 +34,17 @@ func TestHasWonWithNonWinnerNumberMustBeFalse(t *testing.T) {
 	assert.False(t, HasWon(bet))
 }
 
+func TestPrizeOfWinnerIsFirstPrizeAndParsesBack(t *testing.T) {
+	bet, err := NewBet("1", "first", "last", "10000000", "2000-12-20", LOTTERY_WINNER_NUMBER)
+	assert.NoError(t, err)
+	prize := PrizeOf(bet)
+	assert.Equal(t, FirstPrize, prize)
+
+	parsed, err := ParsePrize(prize.String())
+	assert.NoError(t, err)
+	assert.Equal(t, prize, parsed)
+}
+
 func TestStoreBetsAndLoadBetsKeepsFieldsData(t *testing.T) {
 	// Clean up any existing file
 	os.Remove(STORAGE_FILEPATH)
@@ -67,6 +82,184 @@ func TestStoreBetsAndLoadBetsKeepsRegistryOrder(t *testing.T) {
 	assertEqualBets(t, toStore[1], fromLoad[1])
 }
 
+func TestForEachVisitsStoredBetsInRegistryOrder(t *testing.T) {
+	os.Remove(STORAGE_FILEPATH)
+
+	bet1, err := NewBet("0", "first_0", "last_0", "10000000", "2000-12-20", 7500)
+	assert.NoError(t, err)
+	bet2, err := NewBet("1", "first_1", "last_1", "10000001", "2000-12-21", 7501)
+	assert.NoError(t, err)
+
+	toStore := []*Bet{bet1, bet2}
+	err = StoreBets(toStore)
+	assert.NoError(t, err)
+
+	var visited []*Bet
+	err = ForEach(func(bet *Bet) error {
+		visited = append(visited, bet)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(visited))
+	assertEqualBets(t, toStore[0], visited[0])
+	assertEqualBets(t, toStore[1], visited[1])
+}
+
+func TestForEachNumbersTicketsAndSkipsCancelledBets(t *testing.T) {
+	os.Remove(STORAGE_FILEPATH)
+	os.Remove(CANCELLATIONS_FILEPATH)
+	defer os.Remove(CANCELLATIONS_FILEPATH)
+
+	bet1, err := NewBet("1", "first_0", "last_0", "10000000", "2000-12-20", 7500)
+	assert.NoError(t, err)
+	bet2, err := NewBet("1", "first_1", "last_1", "10000001", "2000-12-21", 7501)
+	assert.NoError(t, err)
+	bet3, err := NewBet("1", "first_2", "last_2", "10000002", "2000-12-22", 7502)
+	assert.NoError(t, err)
+	err = StoreBets([]*Bet{bet1, bet2, bet3})
+	assert.NoError(t, err)
+
+	err = StoreCancellation(Cancellation{Ticket: 2, Agency: 1})
+	assert.NoError(t, err)
+
+	var tickets []int64
+	err = ForEach(func(bet *Bet) error {
+		tickets = append(tickets, bet.Ticket)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 3}, tickets)
+
+	cancellations, err := LoadCancellations()
+	assert.NoError(t, err)
+	assert.Equal(t, map[int64]Cancellation{2: {Ticket: 2, Agency: 1}}, cancellations)
+}
+
+func TestStoreBetsAndLoadBetsKeepsTickets(t *testing.T) {
+	os.Remove(STORAGE_FILEPATH)
+
+	bet, err := NewBet("1", "first", "last", "10000000", "2000-12-20", 7500)
+	assert.NoError(t, err)
+	bet.Ticket = 42
+	err = StoreBets([]*Bet{bet})
+	assert.NoError(t, err)
+
+	fromLoad, err := LoadBets()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(fromLoad))
+	assert.Equal(t, int64(42), fromLoad[0].Ticket)
+}
+
+func TestLoadBetsNumbersLegacyRecordsByPosition(t *testing.T) {
+	legacy := "1,first_0,last_0,10000000,2000-12-20,7500\n1,first_1,last_1,10000001,2000-12-21,7501\n"
+	err := os.WriteFile(STORAGE_FILEPATH, []byte(legacy), 0644)
+	assert.NoError(t, err)
+
+	bet, err := NewBet("1", "first_2", "last_2", "10000002", "2000-12-22", 7502)
+	assert.NoError(t, err)
+	bet.Ticket = 3
+	err = StoreBets([]*Bet{bet})
+	assert.NoError(t, err)
+
+	fromLoad, err := LoadBets()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(fromLoad))
+	for i, loaded := range fromLoad {
+		assert.Equal(t, int64(i+1), loaded.Ticket)
+	}
+}
+
+func TestReadBetReadsTheRecordAtTheOffsetsReturnedWhenStoring(t *testing.T) {
+	legacy := "1,first_0,last_0,10000000,2000-12-20,7500\n\n"
+	err := os.WriteFile(STORAGE_FILEPATH, []byte(legacy), 0644)
+	assert.NoError(t, err)
+	os.Remove(CANCELLATIONS_FILEPATH)
+
+	quoted, err := NewBet("1", "first, \"quoted\"", "last\nwith break", "10000001", "2000-12-21", 7501)
+	assert.NoError(t, err)
+	quoted.Ticket = 2
+	plain, err := NewBet("1", "first_2", "last_2", "10000002", "2000-12-22", 7502)
+	assert.NoError(t, err)
+	plain.Ticket = 3
+	offsets, err := AppendBets([]*Bet{quoted, plain})
+	assert.NoError(t, err)
+
+	visited := make(map[int64]int64)
+	err = ForEachWithOffset(func(bet *Bet, offset int64) error {
+		visited[bet.Ticket] = offset
+		read, err := ReadBet(offset, bet.Ticket)
+		assert.NoError(t, err)
+		assert.Equal(t, bet, read)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int64]int64{1: 0, 2: offsets[0], 3: offsets[1]}, visited)
+
+	read, err := ReadBet(offsets[0], 2)
+	assert.NoError(t, err)
+	assert.Equal(t, quoted, read)
+}
+
+func TestForEachWithoutStoredBetsVisitsNothing(t *testing.T) {
+	os.Remove(STORAGE_FILEPATH)
+
+	visited := 0
+	err := ForEach(func(bet *Bet) error {
+		visited++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, visited)
+}
+
+func TestWriterAndScanFileKeepBetsInEveryFormat(t *testing.T) {
+	bet, err := NewBet("1", "first", "last", "10000000", "2000-12-20", 7500)
+	assert.NoError(t, err)
+	bet.Ticket = 42
+
+	for _, format := range []Format{CSVFormat, JSONLFormat} {
+		path := filepath.Join(t.TempDir(), "bets."+string(format))
+		file, err := os.Create(path)
+		assert.NoError(t, err)
+		writer, err := NewWriter(file, format)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Write(bet))
+		assert.NoError(t, writer.Flush())
+		assert.NoError(t, file.Close())
+		assert.Equal(t, format, FormatOf(path))
+
+		var records []Record
+		err = ScanFile(path, format, func(record Record) error {
+			records = append(records, record)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Len(t, records, 1)
+		assert.NoError(t, records[0].Err)
+		assertEqualBets(t, bet, records[0].Bet)
+		assert.Equal(t, int64(42), records[0].Bet.Ticket)
+	}
+}
+
+func TestScanFileReportsMalformedLinesAndKeepsGoing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	content := "1,first,last,10000000,2000-12-20,7500\n1,\"first,last\n\nx,first,last,10000000,2000-12-20,7500\n1,first,last,10000000,2000-12-20,7500\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	var lines []int
+	var failed []int
+	err := ScanFile(path, CSVFormat, func(record Record) error {
+		lines = append(lines, record.Line)
+		if record.Err != nil {
+			failed = append(failed, record.Line)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 4, 5}, lines)
+	assert.Equal(t, []int{2, 4}, failed)
+}
+
 func assertEqualBets(t *testing.T, b1, b2 *Bet) {
 	assert.Equal(t, b1.Agency, b2.Agency)
 	assert.Equal(t, b1.FirstName, b2.FirstName)
@@ -75,3 +268,126 @@ func assertEqualBets(t *testing.T, b1, b2 *Bet) {
 	assert.Equal(t, b1.BirthDate, b2.BirthDate)
 	assert.Equal(t, b1.Number, b2.Number)
 }
+
+func TestLoadDrawStateWithoutFileIsOpenAndEmpty(t *testing.T) {
+	os.Remove(STATE_FILEPATH)
+
+	state, err := LoadDrawState()
+	assert.NoError(t, err)
+	assert.False(t, state.Closed)
+	assert.Empty(t, state.FinishedAgencies)
+	assert.Nil(t, state.Winners)
+}
+
+func TestStoreDrawStateAndLoadDrawStateKeepsProgress(t *testing.T) {
+	os.Remove(STATE_FILEPATH)
+
+	finished := map[int]bool{3: true, 1: true}
+	err := StoreDrawState(NewDrawState(finished, nil))
+	assert.NoError(t, err)
+
+	state, err := LoadDrawState()
+	assert.NoError(t, err)
+	assert.False(t, state.Closed)
+	assert.Equal(t, []int{1, 3}, state.FinishedAgencies)
+	assert.Equal(t, finished, state.FinishedSet())
+}
+
+func TestLoadDrawStateAcceptsWinnersWithoutTickets(t *testing.T) {
+	err := os.WriteFile(STATE_FILEPATH, []byte(`{"finished_agencies":[1],"closed":true,"winners":{"1":["10000000"]}}`), 0644)
+	assert.NoError(t, err)
+
+	state, err := LoadDrawState()
+	assert.NoError(t, err)
+	assert.Equal(t, map[int][]Winner{1: {{Document: "10000000"}}}, state.Winners)
+}
+
+func TestStoreDrawStateAndLoadDrawStateKeepsWinners(t *testing.T) {
+	os.Remove(STATE_FILEPATH)
+
+	winners := map[int][]Winner{1: {{Ticket: 1, Document: "10000000"}, {Ticket: 3, Document: "10000001"}}, 2: {}}
+	err := StoreDrawState(NewDrawState(map[int]bool{1: true, 2: true}, winners))
+	assert.NoError(t, err)
+
+	state, err := LoadDrawState()
+	assert.NoError(t, err)
+	assert.True(t, state.Closed)
+	assert.Equal(t, winners, state.Winners)
+}
+
+const benchmarkBetsAmount = 2_000_000
+
+var benchmarkStorageOnce sync.Once
+
+// benchmarkStorage Writes a storage file with benchmarkBetsAmount bets in
+// the temp dir, once per test binary run, and returns its path
+func benchmarkStorage(b *testing.B) string {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("bets-benchmark-%v.csv", benchmarkBetsAmount))
+	benchmarkStorageOnce.Do(func() {
+		file, err := os.Create(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer file.Close()
+
+		writer := bufio.NewWriter(file)
+		for i := 0; i < benchmarkBetsAmount; i++ {
+			fmt.Fprintf(writer, "%v,Name,Surname,%08d,2000-01-01,%v\n", i%5+1, i, i%10000)
+		}
+		if err := writer.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	})
+	return path
+}
+
+func BenchmarkLoadBetsWinners(b *testing.B) {
+	path := benchmarkStorage(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		loaded, err := loadBetsFrom(path, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		winners := 0
+		for _, bet := range loaded {
+			if HasWon(bet) {
+				winners++
+			}
+		}
+	}
+}
+
+func BenchmarkForEachWinners(b *testing.B) {
+	path := benchmarkStorage(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		winners := 0
+		err := forEachIn(path, nil, func(bet *Bet) error {
+			if HasWon(bet) {
+				winners++
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStoreBatchProgressAndLoadBatchProgressKeepsEveryAgency(t *testing.T) {
+	os.Remove(PROGRESS_FILEPATH)
+	defer os.Remove(PROGRESS_FILEPATH)
+
+	progress, err := LoadBatchProgress()
+	assert.NoError(t, err)
+	assert.Empty(t, progress)
+
+	stored := map[int]BatchProgress{1: {Session: 10, Last: 3}, 4: {Session: 20, Last: 1}}
+	assert.NoError(t, StoreBatchProgress(stored))
+	progress, err = LoadBatchProgress()
+	assert.NoError(t, err)
+	assert.Equal(t, stored, progress)
+}
@@ -0,0 +1,89 @@
+package bets
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const CANCELLATIONS_FILEPATH = "./cancelled_bets.csv"
+
+// Cancellation Tombstone of a stored bet that must no longer take part in
+// the draw. Amended bets are cancelled and replaced by a new bet, whose
+// ticket is kept in ReplacedBy
+type Cancellation struct {
+	Ticket     int64
+	Agency     int
+	ReplacedBy int64
+}
+
+// StoreCancellation Appends the tombstone to the cancellations storage
+func StoreCancellation(cancellation Cancellation) error {
+	file, err := os.OpenFile(CANCELLATIONS_FILEPATH, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	record := []string{
+		strconv.FormatInt(cancellation.Ticket, 10),
+		strconv.Itoa(cancellation.Agency),
+		strconv.FormatInt(cancellation.ReplacedBy, 10),
+	}
+	if err := writer.Write(record); err != nil {
+		return fmt.Errorf("error writing record: %v", err)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error writing record: %v", err)
+	}
+	return nil
+}
+
+// LoadCancellations Returns every stored tombstone by the ticket it cancels
+func LoadCancellations() (map[int64]Cancellation, error) {
+	return LoadCancellationsFrom(CANCELLATIONS_FILEPATH)
+}
+
+// LoadCancellationsFrom Same as LoadCancellations for the tombstones stored
+// at path
+func LoadCancellationsFrom(path string) (map[int64]Cancellation, error) {
+	cancellations := make(map[int64]Cancellation)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cancellations, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 3
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return cancellations, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading record: %v", err)
+		}
+
+		ticket, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error converting ticket to int: %v", err)
+		}
+		agency, err := strconv.Atoi(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("error converting agency to int: %v", err)
+		}
+		replacedBy, err := strconv.ParseInt(record[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error converting ticket to int: %v", err)
+		}
+		cancellations[ticket] = Cancellation{Ticket: ticket, Agency: agency, ReplacedBy: replacedBy}
+	}
+}
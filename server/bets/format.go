@@ -0,0 +1,221 @@
+package bets
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Format Encoding of a bets store file
+type Format string
+
+const (
+	// CSVFormat One record per bet, as the server stores them
+	CSVFormat Format = "csv"
+	// JSONLFormat One JSON object per line and bet
+	JSONLFormat Format = "jsonl"
+)
+
+// ParseFormat Returns the format with the given name
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case CSVFormat:
+		return CSVFormat, nil
+	case JSONLFormat, "json":
+		return JSONLFormat, nil
+	}
+	return "", fmt.Errorf("unknown bets format %q", name)
+}
+
+// FormatOf Guesses the format of a store from the extension of its path.
+// Anything that is not .jsonl or .json is read as CSV
+func FormatOf(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".json":
+		return JSONLFormat
+	}
+	return CSVFormat
+}
+
+// jsonBet How a bet is encoded in the JSONL format
+type jsonBet struct {
+	Ticket    int64  `json:"ticket,omitempty"`
+	Agency    int    `json:"agency"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Document  string `json:"document"`
+	BirthDate string `json:"birth_date"`
+	Number    int    `json:"number"`
+}
+
+// Record One entry of a store file. Bet is nil and Err is set when the line
+// could not be parsed
+type Record struct {
+	Line int
+	Bet  *Bet
+	Err  error
+}
+
+// ScanFile Calls fn for every record of the store at path, in order,
+// including the ones that can't be parsed, so a malformed line doesn't hide
+// the rest of the file. Records without a ticket get their 1-based position
+// as ticket, like in the server storage. Scanning stops at the first error
+// returned by fn or when the file can't be read any further
+func ScanFile(path string, format Format, fn func(Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	switch format {
+	case CSVFormat:
+		return scanLines(file, parseCSVLine, fn)
+	case JSONLFormat:
+		return scanLines(file, parseJSONLine, fn)
+	}
+	return fmt.Errorf("unknown bets format %q", format)
+}
+
+// scanLines Calls fn with the record parse makes of every non empty line
+func scanLines(r io.Reader, parse func(line string, position int64) (*Bet, error), fn func(Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	position := int64(0)
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		position++
+
+		bet, err := parse(scanner.Text(), position)
+		if err := fn(Record{Line: line, Bet: bet, Err: err}); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading record: %v", err)
+	}
+	return nil
+}
+
+// parseCSVLine Parses a line on its own, so an unbalanced quote only spoils
+// its own line. The server never writes records spanning several lines
+func parseCSVLine(line string, position int64) (*Bet, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.TrimLeadingSpace = true
+	record, err := reader.Read()
+	var parseError *csv.ParseError
+	if errors.As(err, &parseError) {
+		return nil, parseError.Err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return betFromRecord(record, position)
+}
+
+func parseJSONLine(line string, position int64) (*Bet, error) {
+	var encoded jsonBet
+	if err := json.Unmarshal([]byte(line), &encoded); err != nil {
+		return nil, fmt.Errorf("error decoding bet: %v", err)
+	}
+	return encoded.bet(position)
+}
+
+func (j jsonBet) bet(position int64) (*Bet, error) {
+	bet, err := NewBet(strconv.Itoa(j.Agency), j.FirstName, j.LastName, j.Document, j.BirthDate, j.Number)
+	if err != nil {
+		return nil, fmt.Errorf("error creating bet: %v", err)
+	}
+	bet.Ticket = j.Ticket
+	if bet.Ticket == 0 {
+		bet.Ticket = position
+	}
+	return bet, nil
+}
+
+// Writer Writes bets to a store file in a given format
+type Writer struct {
+	format  Format
+	csv     *csv.Writer
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// NewWriter Returns a writer of bets to w in the given format. Flush must be
+// called once every bet is written
+func NewWriter(w io.Writer, format Format) (*Writer, error) {
+	switch format {
+	case CSVFormat:
+		return &Writer{format: format, csv: csv.NewWriter(w)}, nil
+	case JSONLFormat:
+		buffer := bufio.NewWriter(w)
+		return &Writer{format: format, buffer: buffer, encoder: json.NewEncoder(buffer)}, nil
+	}
+	return nil, fmt.Errorf("unknown bets format %q", format)
+}
+
+// Write Writes one bet
+func (w *Writer) Write(bet *Bet) error {
+	if w.format == CSVFormat {
+		if err := w.csv.Write(betRecord(bet)); err != nil {
+			return fmt.Errorf("error writing record: %v", err)
+		}
+		return nil
+	}
+	encoded := jsonBet{
+		Ticket:    bet.Ticket,
+		Agency:    bet.Agency,
+		FirstName: bet.FirstName,
+		LastName:  bet.LastName,
+		Document:  bet.Document,
+		BirthDate: bet.BirthDate.Format("2006-01-02"),
+		Number:    bet.Number,
+	}
+	if err := w.encoder.Encode(encoded); err != nil {
+		return fmt.Errorf("error writing record: %v", err)
+	}
+	return nil
+}
+
+// Flush Writes any buffered bet to the underlying writer
+func (w *Writer) Flush() error {
+	if w.format == CSVFormat {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return fmt.Errorf("error writing record: %v", err)
+		}
+		return nil
+	}
+	if err := w.buffer.Flush(); err != nil {
+		return fmt.Errorf("error writing record: %v", err)
+	}
+	return nil
+}
+
+// betRecord Storage record of a bet. Bets without a ticket get the legacy
+// six-field record
+func betRecord(bet *Bet) []string {
+	record := []string{
+		strconv.Itoa(bet.Agency),
+		bet.FirstName,
+		bet.LastName,
+		bet.Document,
+		bet.BirthDate.Format("2006-01-02"),
+		strconv.Itoa(bet.Number),
+	}
+	if bet.Ticket != 0 {
+		record = append(record, strconv.FormatInt(bet.Ticket, 10))
+	}
+	return record
+}
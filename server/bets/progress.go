@@ -0,0 +1,53 @@
+package bets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const PROGRESS_FILEPATH = "./batch_progress.json"
+
+// BatchProgress Last numbered batch stored for an agency in its current
+// session. It is kept next to the bets storage so a batch sent again after
+// a server restart is not stored twice
+type BatchProgress struct {
+	Session int64 `json:"session"`
+	Last    int64 `json:"last"`
+	// Ticket First ticket of the bets of the last batch. The progress is
+	// stored right before them, if the ticket is not in the storage the
+	// last batch stored is the previous one
+	Ticket int64 `json:"ticket"`
+}
+
+// StoreBatchProgress Persists the progress of every agency, replacing the
+// previous one atomically like the draw state. It is stored after every
+// batch, so like the bets storage it is not synced to disk each time
+func StoreBatchProgress(progress map[int]BatchProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("error encoding batch progress: %v", err)
+	}
+	if err := writeFileAtomically(PROGRESS_FILEPATH, data, false); err != nil {
+		return fmt.Errorf("error storing batch progress: %v", err)
+	}
+	return nil
+}
+
+// LoadBatchProgress Reads the persisted progress of every agency. If it was
+// never stored no agency has progress
+func LoadBatchProgress() (map[int]BatchProgress, error) {
+	progress := make(map[int]BatchProgress)
+	data, err := os.ReadFile(PROGRESS_FILEPATH)
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return nil, fmt.Errorf("error decoding batch progress: %v", err)
+	}
+	return progress, nil
+}
@@ -0,0 +1,126 @@
+package bets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const STATE_FILEPATH = "./draw_state.json"
+
+// Winner A winning ticket and the document of who placed the bet
+type Winner struct {
+	Ticket   int64  `json:"ticket"`
+	Document string `json:"document"`
+}
+
+// UnmarshalJSON Also accepts a plain document, which is how winners were
+// stored before they carried their ticket
+func (w *Winner) UnmarshalJSON(data []byte) error {
+	var document string
+	if err := json.Unmarshal(data, &document); err == nil {
+		*w = Winner{Document: document}
+		return nil
+	}
+
+	type winner Winner
+	return json.Unmarshal(data, (*winner)(w))
+}
+
+// DrawState Progress of the draw that must survive a server restart. It is
+// kept next to the bets storage
+type DrawState struct {
+	FinishedAgencies []int            `json:"finished_agencies"`
+	Closed           bool             `json:"closed"`
+	Winners          map[int][]Winner `json:"winners,omitempty"`
+	// Agencies Amount of agencies the draw was waiting for when it closed
+	Agencies int `json:"agencies,omitempty"`
+}
+
+// NewDrawState Builds the state of a draw from the set of agencies that
+// already sent all their bets. A nil winners map means the draw is still open
+func NewDrawState(finishedAgencies map[int]bool, winners map[int][]Winner) *DrawState {
+	state := &DrawState{
+		FinishedAgencies: make([]int, 0, len(finishedAgencies)),
+		Closed:           winners != nil,
+		Winners:          winners,
+	}
+	for agency := range finishedAgencies {
+		state.FinishedAgencies = append(state.FinishedAgencies, agency)
+	}
+	sort.Ints(state.FinishedAgencies)
+	return state
+}
+
+// FinishedSet Returns the finished agencies as a set
+func (d *DrawState) FinishedSet() map[int]bool {
+	finished := make(map[int]bool, len(d.FinishedAgencies))
+	for _, agency := range d.FinishedAgencies {
+		finished[agency] = true
+	}
+	return finished
+}
+
+// StoreDrawState Persists the draw state. The file is written to a temporary
+// path and renamed over the previous one so a crash never leaves it half written
+func StoreDrawState(state *DrawState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error encoding draw state: %v", err)
+	}
+	if err := writeFileAtomically(STATE_FILEPATH, data, true); err != nil {
+		return fmt.Errorf("error storing draw state: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomically Replaces the file at path by one with data. It is
+// written to a temporary path, synced to disk if sync is set, and renamed
+// over the previous one
+func writeFileAtomically(path string, data []byte, sync bool) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return fmt.Errorf("error syncing file: %v", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error replacing file: %v", err)
+	}
+	return nil
+}
+
+// LoadDrawState Reads the persisted draw state. If it was never stored an
+// empty, open draw is returned
+func LoadDrawState() (*DrawState, error) {
+	data, err := os.ReadFile(STATE_FILEPATH)
+	if os.IsNotExist(err) {
+		return &DrawState{FinishedAgencies: []int{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+
+	var state DrawState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error decoding draw state: %v", err)
+	}
+	if state.Closed && state.Winners == nil {
+		state.Winners = make(map[int][]Winner)
+	}
+	return &state, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/audit"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/report"
+)
+
+// commands Maintenance commands that run instead of the server when their
+// name is the first argument. Each one returns the process exit code
+var commands = map[string]func(args []string) int{
+	"verify-audit": verifyAuditCommand,
+	"report":       reportCommand,
+}
+
+// verifyAuditCommand Walks the audit log chain and cross-checks it against
+// the bets storage and the draw state in the working directory
+func verifyAuditCommand(args []string) int {
+	path := audit.AUDIT_FILEPATH
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	report, err := audit.Verify(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error verifying audit log: %v\n", err)
+		return 1
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	if !report.Ok() {
+		fmt.Printf("audit log %v is NOT consistent: %v problems | entries: %v | stored bets: %v\n", path, len(report.Problems), report.Entries, report.Bets)
+		return 2
+	}
+	fmt.Printf("audit log %v is consistent | entries: %v | stored bets: %v\n", path, report.Entries, report.Bets)
+	return 0
+}
+
+// reportCommand Regenerates the results report of the closed draw from the
+// bets storage and the draw state in the working directory
+func reportCommand(args []string) int {
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+
+	state, err := bets.LoadDrawState()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading draw state: %v\n", err)
+		return 1
+	}
+	if !state.Closed {
+		fmt.Fprintln(os.Stderr, "the draw is still open, there are no results to report")
+		return 1
+	}
+
+	results, err := report.Build(state.Agencies, state.FinishedSet(), bets.ForEach)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error building report: %v\n", err)
+		return 1
+	}
+	csvPath, jsonPath, err := results.Store(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error storing report: %v\n", err)
+		return 1
+	}
+	fmt.Printf("results report written to %v and %v | bets: %v | winners: %v | missing agencies: %v | unseen agencies: %v\n",
+		csvPath, jsonPath, results.TotalBets, len(results.Winners), results.MissingAgencies, results.UnseenAgencies)
+	return 0
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+// ackHistory Acknowledgements kept per agency to answer batches sent again
+// after a reconnection
+const ackHistory = 256
+
+// batchStream Numbered batches received from an agency in its current
+// session. The mutex keeps the batches of the agency in order even if they
+// arrive on different connections. The session and last batch stored are
+// persisted, the acknowledgements are not
+type batchStream struct {
+	mutex   sync.Mutex
+	session int64
+	last    int64
+	acks    map[int64]shared.BetResponse
+}
+
+// batchStream Returns the stream of numbered batches of the agency
+func (s *Server) batchStream(agency int) *batchStream {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+	stream, ok := s.batchStreams[agency]
+	if !ok {
+		stream = &batchStream{}
+		s.batchStreams[agency] = stream
+	}
+	return stream
+}
+
+// storeBatchProgress Persists the batch of the agency about to be stored.
+// A failure is logged and the batch is still stored, it could only be
+// stored again if it is sent again after a restart
+func (s *Server) storeBatchProgress(agency int, progress bets.BatchProgress) {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+	s.batchProgress[agency] = progress
+	if err := bets.StoreBatchProgress(s.batchProgress); err != nil {
+		log.Printf("action: store_batch_progress | result: fail | agency: %v | error: %v", agency, err)
+	}
+}
+
+// handleNumberedBatchMessage Stores a numbered batch if it is the next one
+// of the agency and acknowledges it with its ID. A batch already stored is
+// not stored again, its acknowledgement is sent again. A batch that comes
+// after a missing one is answered busy, so the agency sends it again once
+// the missing one is stored. A batch with bets of another agency is
+// rejected whole. The progress of the agency is persisted right before
+// storing the bets, so batches sent again after a restart are still
+// recognized
+func (s *Server) handleNumberedBatchMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	numberedBatchMessage := message.(*shared.NumberedBatchMessage)
+	agency := numberedBatchMessage.Agency
+	batchID := numberedBatchMessage.BatchID
+
+	stream := s.batchStream(agency)
+	stream.mutex.Lock()
+	if stream.session != numberedBatchMessage.Session {
+		stream.session = numberedBatchMessage.Session
+		stream.last = 0
+		stream.acks = make(map[int64]shared.BetResponse)
+	}
+
+	var response shared.BetResponse
+	switch {
+	case batchID <= stream.last:
+		var ok bool
+		response, ok = stream.acks[batchID]
+		if !ok {
+			// Too old to remember its tickets, but it was stored
+			response = shared.BetResponse{Success: true}
+		}
+		log.Printf("action: apuesta_recibida | result: duplicate | agency: %v | batch: %v", agency, batchID)
+	case batchID > stream.last+1:
+		log.Printf("action: apuesta_recibida | result: busy | agency: %v | batch: %v | expected_batch: %v", agency, batchID, stream.last+1)
+		response = shared.BetResponse{Busy: true}
+	default:
+		response = s.receiveBatch(agency, numberedBatchMessage.ReceivedBets, func(firstTicket int64) {
+			s.storeBatchProgress(agency, bets.BatchProgress{Session: stream.session, Last: batchID, Ticket: firstTicket})
+		})
+		if !response.Busy {
+			stream.last = batchID
+			stream.acks[batchID] = response
+			delete(stream.acks, batchID-ackHistory)
+		}
+	}
+	stream.mutex.Unlock()
+
+	ack := shared.BatchAckMessage{BatchID: batchID, Response: response}
+	if _, err := clientConn.WriteMessage(&ack); err != nil {
+		log.Printf("action: batch_ack | result: fail | agency: %v | batch: %v | error: %v", agency, batchID, err)
+	}
+}
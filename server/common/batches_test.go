@@ -0,0 +1,100 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchOf Returns the records of a batch with a bet of each agency given
+func batchOf(agencies ...int) [][]string {
+	batch := make([][]string, 0, len(agencies))
+	for i, agency := range agencies {
+		batch = append(batch, []string{fmt.Sprint(agency), "first", "last", fmt.Sprint(10000000 + i), "2000-12-20", "7500"})
+	}
+	return batch
+}
+
+func sendBatch(t *testing.T, s *Server, agency int, session int64, batchID int64, batch [][]string) shared.BetResponse {
+	message := &shared.NumberedBatchMessage{Agency: agency, Session: session, BatchID: batchID, ReceivedBets: batch}
+	ack := handle(t, s, message).(*shared.BatchAckMessage)
+	assert.Equal(t, batchID, ack.BatchID)
+	return ack.Response
+}
+
+func storedBets(t *testing.T) int {
+	stored := 0
+	assert.NoError(t, bets.ForEach(func(*bets.Bet) error {
+		stored++
+		return nil
+	}))
+	return stored
+}
+
+func TestBatchWithBetsOfAnotherAgencyIsRejectedWhole(t *testing.T) {
+	s := startServer(t)
+
+	response := sendBatch(t, s, 1, 1, 1, batchOf(1, 2, 1))
+	assert.False(t, response.Success)
+	assert.Empty(t, response.Tickets)
+	assert.Equal(t, 0, storedBets(t))
+
+	response = sendBatch(t, s, 1, 1, 2, batchOf(1, 1))
+	assert.True(t, response.Success)
+	assert.Equal(t, []int64{1, 2}, response.Tickets)
+}
+
+func TestNumberedBatchesAreStoredInOrderAndOnlyOnce(t *testing.T) {
+	s := startServer(t)
+
+	assert.Equal(t, []int64{1}, sendBatch(t, s, 1, 1, 1, batchOf(1)).Tickets)
+	// Batch 2 is missing, so batch 3 must wait
+	assert.True(t, sendBatch(t, s, 1, 1, 3, batchOf(1, 1)).Busy)
+	assert.Equal(t, 1, storedBets(t))
+
+	assert.Equal(t, []int64{2, 3}, sendBatch(t, s, 1, 1, 2, batchOf(1, 1)).Tickets)
+	// A batch sent again gets the same acknowledgement without being stored
+	response := sendBatch(t, s, 1, 1, 1, batchOf(1))
+	assert.True(t, response.Success)
+	assert.Equal(t, []int64{1}, response.Tickets)
+	assert.Equal(t, 3, storedBets(t))
+
+	assert.Equal(t, []int64{4, 5}, sendBatch(t, s, 1, 1, 3, batchOf(1, 1)).Tickets)
+	// Batch IDs are counted per agency
+	assert.Equal(t, []int64{6}, sendBatch(t, s, 2, 1, 1, batchOf(2)).Tickets)
+}
+
+func TestBatchStreamResumesAfterRestart(t *testing.T) {
+	inTempDir(t)
+	s, stop := runServer(t)
+	assert.True(t, sendBatch(t, s, 1, 7, 1, batchOf(1)).Success)
+	assert.True(t, sendBatch(t, s, 1, 7, 2, batchOf(1, 1)).Success)
+	stop()
+
+	s, _ = runServer(t)
+	// The acknowledgement of batch 2 was lost, the agency sends it again
+	assert.True(t, sendBatch(t, s, 1, 7, 2, batchOf(1, 1)).Success)
+	assert.Equal(t, 3, storedBets(t))
+	assert.Equal(t, []int64{4}, sendBatch(t, s, 1, 7, 3, batchOf(1)).Tickets)
+
+	// A new session of the agency starts again from batch 1
+	assert.Equal(t, []int64{5}, sendBatch(t, s, 1, 8, 1, batchOf(1)).Tickets)
+	assert.Equal(t, 5, storedBets(t))
+}
+
+func TestBatchNotStoredBeforeRestartIsStoredWhenSentAgain(t *testing.T) {
+	inTempDir(t)
+	s, stop := runServer(t)
+	assert.True(t, sendBatch(t, s, 1, 7, 1, batchOf(1, 1)).Success)
+	stop()
+	// The server stopped right after storing the progress of batch 2,
+	// before storing its bets
+	assert.NoError(t, bets.StoreBatchProgress(map[int]bets.BatchProgress{1: {Session: 7, Last: 2, Ticket: 3}}))
+
+	s, _ = runServer(t)
+	assert.Equal(t, []int64{3}, sendBatch(t, s, 1, 7, 2, batchOf(1)).Tickets)
+	assert.Equal(t, 3, storedBets(t))
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/audit"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+)
+
+// handleCancelBetMessage Voids a stored bet. The bet is kept in storage and
+// a tombstone is recorded so it no longer takes part in the draw
+func (s *Server) handleCancelBetMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	cancelBetMessage := message.(*shared.CancelBetMessage)
+
+	s.betsMutex.Lock()
+	err := s.cancelBetLocked(cancelBetMessage.Agency, cancelBetMessage.Ticket)
+	s.betsMutex.Unlock()
+
+	if err != nil {
+		log.Printf("action: apuesta_cancelada | result: fail | agency: %v | ticket: %v | error: %v", cancelBetMessage.Agency, cancelBetMessage.Ticket, err)
+		sendResponse(clientConn, shared.BetResponse{Success: false})
+		return
+	}
+
+	log.Printf("action: apuesta_cancelada | result: success | agency: %v | ticket: %v", cancelBetMessage.Agency, cancelBetMessage.Ticket)
+	sendResponse(clientConn, shared.BetResponse{Success: true, Tickets: []int64{cancelBetMessage.Ticket}})
+}
+
+// handleAmendBetMessage Replaces a stored bet by a corrected one. The new
+// bet gets a new ticket, which is returned in the acknowledgement, and the
+// old one is cancelled
+func (s *Server) handleAmendBetMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	amendBetMessage := message.(*shared.AmendBetMessage)
+	amended := amendBetMessage.Bet
+
+	s.betsMutex.Lock()
+	err := s.amendBetLocked(amendBetMessage.Ticket, &amended)
+	s.betsMutex.Unlock()
+
+	if err != nil {
+		log.Printf("action: apuesta_corregida | result: fail | agency: %v | ticket: %v | error: %v", amended.Agency, amendBetMessage.Ticket, err)
+		response := shared.BetResponse{Success: false}
+		if amended.Ticket != 0 {
+			// The corrected bet was stored even if the old one could not be
+			// cancelled, the agency needs its ticket to void it
+			response.Tickets = []int64{amended.Ticket}
+		}
+		sendResponse(clientConn, response)
+		return
+	}
+
+	log.Printf("action: apuesta_corregida | result: success | agency: %v | ticket: %v | nuevo_ticket: %v | dni: %v | numero: %v",
+		amended.Agency, amendBetMessage.Ticket, amended.Ticket, amended.Document, amended.Number)
+	sendResponse(clientConn, shared.BetResponse{Success: true, Tickets: []int64{amended.Ticket}})
+}
+
+// betToChangeLocked Returns the bet with the given ticket if the agency may
+// still change it. Must be called with betsMutex held
+func (s *Server) betToChangeLocked(agency int, ticket int64) (*bets.Bet, error) {
+	if s.drawFrozen {
+		return nil, errors.New("draw already closed")
+	}
+	if s.finishedAgencies[agency] {
+		return nil, fmt.Errorf("agency %v already sent all its bets", agency)
+	}
+	location, ok := s.betLocations[ticket]
+	if !ok || location.agency != agency {
+		return nil, fmt.Errorf("ticket %v not found for agency %v", ticket, agency)
+	}
+	return bets.ReadBet(location.offset, ticket)
+}
+
+func (s *Server) cancelBetLocked(agency int, ticket int64) error {
+	bet, err := s.betToChangeLocked(agency, ticket)
+	if err != nil {
+		return err
+	}
+
+	cancellation := bets.Cancellation{Ticket: ticket, Agency: agency}
+	err = bets.StoreCancellation(cancellation)
+	if err != nil {
+		return err
+	}
+	s.unindexBet(bet)
+	s.recordAudit(audit.BetCancelledEntry(cancellation))
+	return nil
+}
+
+// amendBetLocked Stores amended with a new ticket and cancels the bet with
+// the given ticket. If only the first step succeeds amended.Ticket is set
+// and an error is returned
+func (s *Server) amendBetLocked(ticket int64, amended *bets.Bet) error {
+	bet, err := s.betToChangeLocked(amended.Agency, ticket)
+	if err != nil {
+		return err
+	}
+
+	if err := s.storeBetsLocked([]*bets.Bet{amended}, nil); err != nil {
+		amended.Ticket = 0
+		return err
+	}
+	cancellation := bets.Cancellation{Ticket: ticket, Agency: amended.Agency, ReplacedBy: amended.Ticket}
+	err = bets.StoreCancellation(cancellation)
+	if err != nil {
+		return err
+	}
+	s.unindexBet(bet)
+	s.recordAudit(audit.BetCancelledEntry(cancellation))
+	return nil
+}
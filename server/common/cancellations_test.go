@@ -0,0 +1,141 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+// startServer Runs a server for two agencies in a temporary directory, so
+// its storage starts empty, and drains it once the test ends
+func startServer(t *testing.T) *Server {
+	inTempDir(t)
+	server, _ := runServer(t)
+	return server
+}
+
+// inTempDir Makes the test run in a temporary directory, where the server
+// keeps its storage
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+// runServer Runs a server for two agencies in the current directory.
+// Returns a function that drains it, which is also called once the test
+// ends
+func runServer(t *testing.T) (*Server, func()) {
+	server, err := NewServer("127.0.0.1:0", 2, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		server.Run(ctx)
+		close(stopped)
+	}()
+	stop := func() {
+		cancel()
+		<-stopped
+	}
+	t.Cleanup(stop)
+	return server, stop
+}
+
+// handle Passes message to its handler as if it came from an agency and
+// returns the response written. AllBetsSent gets no response, its handler
+// is called directly
+func handle(t *testing.T, s *Server, message shared.Message) shared.Message {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		messageHandlers[message.GetMessageType()](s, context.Background(), message, shared.NewConn(server))
+		server.Close()
+	}()
+	response, err := shared.NewConn(client).ReadMessage()
+	assert.NoError(t, err)
+	return response
+}
+
+func newBet(t *testing.T, agency int, document string) bets.Bet {
+	bet, err := bets.NewBet(fmt.Sprint(agency), "first", "last", document, "2000-12-20", 7500)
+	assert.NoError(t, err)
+	return *bet
+}
+
+func TestBetsCanOnlyBeChangedByTheirAgencyWhileItIsSendingThem(t *testing.T) {
+	cancel := func(agency int, ticket int64) shared.Message {
+		return &shared.CancelBetMessage{Agency: agency, Ticket: ticket}
+	}
+	amend := func(agency int, ticket int64) shared.Message {
+		return &shared.AmendBetMessage{Ticket: ticket, Bet: newBet(t, agency, "20000000")}
+	}
+	tests := []struct {
+		name string
+		// finished Agencies that send AllBetsSent before the change
+		finished []int
+		// closeDraw Whether the draw is closed before the change, with
+		// agency 1 still sending its bets
+		closeDraw bool
+		change    func(agency int, ticket int64) shared.Message
+		agency    int
+		ticket    int64
+		success   bool
+		// committed Bets of agency 1 taking part in the draw afterwards
+		committed int
+	}{
+		{name: "cancel own bet", change: cancel, agency: 1, ticket: 1, success: true, committed: 1},
+		{name: "amend own bet", change: amend, agency: 1, ticket: 1, success: true, committed: 2},
+		{name: "cancel after all bets sent", finished: []int{1}, change: cancel, agency: 1, ticket: 1, committed: 2},
+		{name: "amend after all bets sent", finished: []int{1}, change: amend, agency: 1, ticket: 1, committed: 2},
+		{name: "cancel once the draw is closed", closeDraw: true, change: cancel, agency: 1, ticket: 1, committed: 2},
+		{name: "amend once the draw is closed", closeDraw: true, change: amend, agency: 1, ticket: 1, committed: 2},
+		{name: "cancel bet of another agency", change: cancel, agency: 2, ticket: 1, committed: 2},
+		{name: "amend bet of another agency", change: amend, agency: 2, ticket: 1, committed: 2},
+		{name: "cancel unknown ticket", change: cancel, agency: 1, ticket: 42, committed: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := startServer(t)
+			// Agency 1 gets tickets 1 and 2, agency 2 gets ticket 3
+			for _, bet := range []bets.Bet{newBet(t, 1, "10000000"), newBet(t, 1, "10000001"), newBet(t, 2, "10000002")} {
+				stored := handle(t, s, &shared.BetMessage{ReceivedBet: bet}).(*shared.BetResponse)
+				assert.True(t, stored.Success)
+			}
+
+			for _, agency := range test.finished {
+				s.handleAllBetsSentMessage(context.Background(), &shared.AllBetsSentMessage{Agency: agency}, nil)
+			}
+			// identifyWinners marks the agencies as finished after taking them
+			for s.finishedAmount() < len(test.finished) {
+				time.Sleep(time.Millisecond)
+			}
+			if test.closeDraw {
+				s.SetAgenciesAmount(1)
+				s.handleAllBetsSentMessage(context.Background(), &shared.AllBetsSentMessage{Agency: 2}, nil)
+				<-s.drawClosed
+			}
+
+			response := handle(t, s, test.change(test.agency, test.ticket)).(*shared.BetResponse)
+			assert.Equal(t, test.success, response.Success)
+
+			status := handle(t, s, &shared.StatusQueryMessage{Agency: 1}).(*shared.StatusMessage)
+			assert.Equal(t, test.committed, status.BetsCommitted)
+			cancellations, err := bets.LoadCancellations()
+			assert.NoError(t, err)
+			_, cancelled := cancellations[test.ticket]
+			assert.Equal(t, test.success, cancelled)
+		})
+	}
+}
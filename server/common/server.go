@@ -1,43 +1,174 @@
 package common
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/audit"
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/report"
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
 )
 
+// BatchLimits Sizes of the batches the server advertises and accepts
+type BatchLimits struct {
+	// PreferredBytes Batch payload size the agencies should aim for
+	PreferredBytes int
+	// MaxBytes Largest batch payload accepted
+	MaxBytes int
+	// MaxBets Most bets accepted in a batch
+	MaxBets int
+	// MaxPending Batches processed at once before answering busy, 0 for no
+	// limit
+	MaxPending int
+}
+
+// DefaultShutdownGrace Time a new server gives its connections to finish
+// the message they are processing when it shuts down
+const DefaultShutdownGrace = 10 * time.Second
+
+// DefaultHeartbeatInterval and DefaultHeartbeatMisses Heartbeat of the
+// connections of a new server with the agencies that send Pings
+const (
+	DefaultHeartbeatInterval = 5 * time.Second
+	DefaultHeartbeatMisses   = 3
+)
+
+// DefaultBatchLimits Batch limits of a new server
+var DefaultBatchLimits = BatchLimits{
+	PreferredBytes: 8 * 1024,
+	MaxBytes:       64 * 1024,
+	MaxBets:        10000,
+	MaxPending:     8,
+}
+
 type Server struct {
 	serverSocket     net.Listener
-	running          bool
 	totalAgencies    int
+	maxConnections   int
+	startedAt        time.Time
+	drawDeadline     time.Duration
+	shutdownGrace    time.Duration
+	heartbeat        heartbeatSettings
+	batchLimits      BatchLimits
+	pendingBatches   int
 	receivedAgencies chan int
-	winners          map[int][]string
+	settingsChanged  chan struct{}
+	drawClosed       chan struct{}
+	finishedAgencies map[int]bool
+	drawFrozen       bool
+	nextTicket       int64
+	winningBets      map[int]map[int64]string
+	// ticketsByDocument Tickets of the bets of each agency by document
+	ticketsByDocument map[int]map[string][]int64
+	// betLocations Where the record of every bet taking part in the draw
+	// is, by ticket. Bets are read back from the storage when needed
+	betLocations map[int64]betLocation
+	// betsCommitted Bets of each agency taking part in the draw
+	betsCommitted    map[int]int
+	winners          map[int][]bets.Winner
 	connections      map[string]net.Conn
+	batchStreams     map[int]*batchStream
+	batchProgress    map[int]bets.BatchProgress
+	auditLog         *audit.Log
 	connectionsMutex sync.Mutex
 	betsMutex        sync.Mutex
 	winnersMutex     sync.Mutex
+	settingsMutex    sync.Mutex
+	streamsMutex     sync.Mutex
 	wg               sync.WaitGroup
+	// handlers Connection handlers running
+	handlers sync.WaitGroup
 }
 
-func NewServer(address string, agenciesAmount int) (*Server, error) {
+func NewServer(address string, agenciesAmount int, maxConnections int) (*Server, error) {
 	server := &Server{
-		running:          true,
-		totalAgencies:    agenciesAmount,
-		receivedAgencies: make(chan int),
-		connections:      make(map[string]net.Conn),
-		connectionsMutex: sync.Mutex{},
-		betsMutex:        sync.Mutex{},
-		winnersMutex:     sync.Mutex{},
-		wg:               sync.WaitGroup{},
+		totalAgencies:     agenciesAmount,
+		maxConnections:    maxConnections,
+		startedAt:         time.Now(),
+		shutdownGrace:     DefaultShutdownGrace,
+		heartbeat:         heartbeatSettings{DefaultHeartbeatInterval, DefaultHeartbeatMisses},
+		batchLimits:       DefaultBatchLimits,
+		receivedAgencies:  make(chan int),
+		settingsChanged:   make(chan struct{}, 1),
+		drawClosed:        make(chan struct{}),
+		nextTicket:        1,
+		winningBets:       make(map[int]map[int64]string),
+		ticketsByDocument: make(map[int]map[string][]int64),
+		betLocations:      make(map[int64]betLocation),
+		betsCommitted:     make(map[int]int),
+		connections:       make(map[string]net.Conn),
+		batchStreams:      make(map[int]*batchStream),
+		connectionsMutex:  sync.Mutex{},
+		betsMutex:         sync.Mutex{},
+		winnersMutex:      sync.Mutex{},
+		settingsMutex:     sync.Mutex{},
+		wg:                sync.WaitGroup{},
+	}
+
+	state, err := bets.LoadDrawState()
+	if err != nil {
+		return nil, fmt.Errorf("error loading draw state: %v", err)
+	}
+	server.finishedAgencies = state.FinishedSet()
+	if state.Closed {
+		server.winners = state.Winners
+		server.drawFrozen = true
+		close(server.drawClosed)
+	}
+	err = bets.ForEachWithOffset(func(bet *bets.Bet, offset int64) error {
+		server.indexBets([]*bets.Bet{bet}, []int64{offset})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading stored bets: %v", err)
+	}
+	// Every stored bet is either indexed or cancelled, so the next ticket
+	// follows the highest of both
+	cancellations, err := bets.LoadCancellations()
+	if err != nil {
+		return nil, fmt.Errorf("error loading cancelled bets: %v", err)
+	}
+	for ticket := range cancellations {
+		if ticket >= server.nextTicket {
+			server.nextTicket = ticket + 1
+		}
+	}
+	log.Printf("action: restore_draw_state | result: success | finished_agencies: %v | closed: %v", state.FinishedAgencies, state.Closed)
+	server.batchProgress, err = bets.LoadBatchProgress()
+	if err != nil {
+		return nil, fmt.Errorf("error loading batch progress: %v", err)
+	}
+	for agency, progress := range server.batchProgress {
+		// The server stopped before storing the last batch if its first
+		// ticket was never used
+		if progress.Ticket >= server.nextTicket {
+			progress.Last--
+		}
+		server.batchStreams[agency] = &batchStream{
+			session: progress.Session,
+			last:    progress.Last,
+			acks:    make(map[int64]shared.BetResponse),
+		}
+	}
+
+	server.auditLog, err = audit.Open(audit.AUDIT_FILEPATH)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
 	}
 
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
+		server.auditLog.Close()
 		return nil, fmt.Errorf("error creating server socket: %v", err)
 	}
 	server.serverSocket = listener
@@ -45,44 +176,235 @@ func NewServer(address string, agenciesAmount int) (*Server, error) {
 	return server, nil
 }
 
-func (s *Server) Run() {
+// Run Answers the agencies until ctx is canceled and then drains the
+// server: it stops accepting connections and lets every handler finish the
+// message it is processing, closing the connections still open once the
+// shutdown grace passes. Then it syncs the storage, persists the draw state
+// and closes the audit log. Returns once the server is drained
+func (s *Server) Run(ctx context.Context) {
+	select {
+	case <-s.drawClosed:
+	default:
+		s.wg.Add(1)
+		go s.identifyWinners(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		s.serverSocket.Close()
+		log.Printf("action: server_socket_closed | result: success")
+	}()
+
+	s.acceptConnections(ctx)
+	// Connections already open are still answered if accepting failed
+	<-ctx.Done()
+	s.drain()
+}
 
-	s.wg.Add(1)
-	go s.identifyWinners()
-	for s.running {
+// acceptConnections Accepts connections and answers each one on its own
+// goroutine until the server socket is closed or fails
+func (s *Server) acceptConnections(ctx context.Context) {
+	for {
 		clientConn, err := s.acceptNewConnection()
 		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("action: accept_connections | result: stopped")
+				return
+			}
 			log.Printf("action: accept_connections | result: failed | error: %v", err)
 			return
 		}
 		s.connectionsMutex.Lock()
+		if limit := s.getMaxConnections(); limit > 0 && len(s.connections) >= limit {
+			s.connectionsMutex.Unlock()
+			log.Printf("action: accept_connections | result: rejected | ip: %v | reason: max_connections %v reached", clientConn.RemoteAddr().String(), limit)
+			clientConn.Close()
+			continue
+		}
 		s.connections[clientConn.RemoteAddr().String()] = clientConn
 		s.connectionsMutex.Unlock()
-		s.wg.Add(1)
-		go s.handleClientConnection(clientConn)
+		s.handlers.Add(1)
+		go s.handleClientConnection(ctx, clientConn)
 	}
 }
 
-func (s *Server) Shutdown() {
-	s.running = false
-	s.connectionsMutex.Lock()
-	defer s.connectionsMutex.Unlock()
-	for _, conn := range s.connections {
-		conn.Close()
-		log.Printf("action: connection_closed | result: success | connection: %v", conn.LocalAddr())
+// SetAgenciesAmount Changes how many agencies must finish before the draw
+// closes. It has no effect once the winners are computed
+func (s *Server) SetAgenciesAmount(amount int) {
+	s.settingsMutex.Lock()
+	s.totalAgencies = amount
+	s.settingsMutex.Unlock()
+
+	// Wake up identifyWinners so it checks the new settings
+	select {
+	case s.settingsChanged <- struct{}{}:
+	default:
 	}
-	if s.serverSocket != nil {
-		s.serverSocket.Close()
-		log.Printf("action: server_socket_closed | result: success")
+}
+
+// SetMaxConnections Changes the limit of simultaneous client connections,
+// 0 means no limit. Connections already open are kept
+func (s *Server) SetMaxConnections(limit int) {
+	s.settingsMutex.Lock()
+	s.maxConnections = limit
+	s.settingsMutex.Unlock()
+}
+
+// SetDrawDeadline Makes the draw close once deadline has passed since the
+// server started, even if some agencies did not send all their bets. 0
+// means the draw waits for every agency
+func (s *Server) SetDrawDeadline(deadline time.Duration) {
+	s.settingsMutex.Lock()
+	s.drawDeadline = deadline
+	s.settingsMutex.Unlock()
+
+	select {
+	case s.settingsChanged <- struct{}{}:
+	default:
 	}
+}
 
-	s.winnersMutex.Lock()
-	if s.winners == nil {
-		s.receivedAgencies <- -1
+// deadlineTimer Returns a timer that fires at the draw deadline, or nil if
+// there is none
+func (s *Server) deadlineTimer() *time.Timer {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	if s.drawDeadline == 0 {
+		return nil
 	}
-	s.winnersMutex.Unlock()
+	return time.NewTimer(time.Until(s.startedAt.Add(s.drawDeadline)))
+}
+
+// SetShutdownGrace Changes how long Shutdown waits for the connections to
+// finish the message they are processing before closing them
+func (s *Server) SetShutdownGrace(grace time.Duration) {
+	s.settingsMutex.Lock()
+	s.shutdownGrace = grace
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getShutdownGrace() time.Duration {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	return s.shutdownGrace
+}
+
+// heartbeatSettings Heartbeat of the connections with the agencies
+type heartbeatSettings struct {
+	interval time.Duration
+	misses   int
+}
+
+// SetHeartbeat Changes the heartbeat of the connections accepted from now
+// on. The server sends a Ping every interval on every connection, whether
+// the agency sends its own or not, and closes it after misses intervals
+// without hearing from the agency. An interval of 0 disables the heartbeat
+func (s *Server) SetHeartbeat(interval time.Duration, misses int) {
+	s.settingsMutex.Lock()
+	s.heartbeat = heartbeatSettings{interval, misses}
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getHeartbeat() heartbeatSettings {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	return s.heartbeat
+}
+
+// SetBatchLimits Changes the batch sizes advertised and accepted. Batches
+// already being processed are not affected
+func (s *Server) SetBatchLimits(limits BatchLimits) {
+	s.settingsMutex.Lock()
+	s.batchLimits = limits
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getBatchLimits() BatchLimits {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	return s.batchLimits
+}
+
+// startBatch Reserves a slot to process a batch. It returns false if the
+// server is already processing as many batches as it allows, otherwise
+// finishBatch must be called once the batch is processed
+func (s *Server) startBatch() bool {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	if s.batchLimits.MaxPending > 0 && s.pendingBatches >= s.batchLimits.MaxPending {
+		return false
+	}
+	s.pendingBatches++
+	return true
+}
 
+func (s *Server) finishBatch() {
+	s.settingsMutex.Lock()
+	s.pendingBatches--
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getTotalAgencies() int {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	return s.totalAgencies
+}
+
+func (s *Server) finishedAmount() int {
+	s.betsMutex.Lock()
+	defer s.betsMutex.Unlock()
+	return len(s.finishedAgencies)
+}
+
+func (s *Server) getMaxConnections() int {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	return s.maxConnections
+}
+
+// drain Waits for the connection handlers, which return once they answer
+// the message they are processing, closing the connections still open
+// after the shutdown grace. Then it syncs the storage, persists the draw
+// state and closes the audit log
+func (s *Server) drain() {
+	grace := s.getShutdownGrace()
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Printf("action: drain_connections | result: success")
+	case <-time.After(grace):
+		s.connectionsMutex.Lock()
+		log.Printf("action: drain_connections | result: timeout | grace: %v | connections: %v", grace, len(s.connections))
+		for _, conn := range s.connections {
+			conn.Close()
+			log.Printf("action: connection_closed | result: success | connection: %v", conn.RemoteAddr())
+		}
+		s.connectionsMutex.Unlock()
+		<-drained
+	}
 	s.wg.Wait()
+
+	if err := bets.SyncStorage(); err != nil {
+		log.Printf("action: sync_storage | result: fail | error: %v", err)
+	}
+	s.winnersMutex.Lock()
+	closed := s.winners != nil
+	s.winnersMutex.Unlock()
+	// A closed draw already stored its state along with the winners
+	if !closed {
+		s.betsMutex.Lock()
+		state := bets.NewDrawState(s.finishedAgencies, nil)
+		s.betsMutex.Unlock()
+		if err := bets.StoreDrawState(state); err != nil {
+			log.Printf("action: store_draw_state | result: fail | error: %v", err)
+		}
+	}
+	if err := s.auditLog.Close(); err != nil {
+		log.Printf("action: audit_log_closed | result: fail | error: %v", err)
+	}
 	log.Print("action: server_shutdown | result: success")
 }
 
@@ -97,186 +419,450 @@ func (s *Server) acceptNewConnection() (net.Conn, error) {
 	return conn, nil
 }
 
-func (s *Server) handleClientConnection(clientConn net.Conn) {
+// handleClientConnection Answers the messages of an agency until it closes
+// the connection or ctx is canceled, in which case the message being
+// processed is answered first
+func (s *Server) handleClientConnection(ctx context.Context, clientConn net.Conn) {
+	// The handler is done only once it left the open connections, so a
+	// drained server no longer touches them
+	defer s.handlers.Done()
 	defer func() {
 		clientConn.Close()
 		s.connectionsMutex.Lock()
 		delete(s.connections, clientConn.RemoteAddr().String())
 		s.connectionsMutex.Unlock()
 	}()
-	defer s.wg.Done()
 
-	errorResponse := shared.BetResponse(false)
-	errorResponseSerialized, err := errorResponse.Serialize()
-
-	if err != nil {
-		log.Printf("action: handle_client_connection | result: fail | error: %v", err)
-		return
+	// The agency may send several messages on the connection, it is closed
+	// once the agency closes its side or sends something unexpected. Replies
+	// carry checksums once the agency sends a frame with one. A compressed
+	// batch may not expand beyond the largest batch accepted. An agency that
+	// goes silent is given up, which reaps the handler, even if it never
+	// sent a Ping
+	conn := shared.NewConn(clientConn)
+	defer conn.Close()
+	conn.SetMaxDecompressedLength(s.getBatchLimits().MaxBytes + shared.NumberedBatchHeaderLength)
+	heartbeat := s.getHeartbeat()
+	conn.SetHeartbeat(heartbeat.interval, heartbeat.misses)
+	conn.StartHeartbeat()
+	for {
+		message, err := conn.ReadMessageContext(ctx)
+		if err == io.EOF || (err != nil && ctx.Err() != nil) {
+			return
+		}
+		if errors.Is(err, shared.ErrPeerUnresponsive) {
+			log.Printf("action: heartbeat | result: fail | ip: %v | error: %v", clientConn.RemoteAddr().String(), err)
+			return
+		}
+		var malformed *shared.MalformedMessageError
+		if errors.As(err, &malformed) {
+			s.rejectMalformedMessage(malformed, conn)
+			continue
+		}
+		if err != nil {
+			log.Printf("action: handle_client_connection | result: fail | error: %v", err)
+			sendResponse(conn, shared.BetResponse{Success: false})
+			return
+		}
+		handle, ok := messageHandlers[message.GetMessageType()]
+		if !ok {
+			log.Printf("action: handle_client_connection | result: fail | error: unexpected message type %v", message.GetMessageType())
+			sendResponse(conn, shared.BetResponse{Success: false})
+			return
+		}
+		handle(s, ctx, message, conn)
+		if ctx.Err() != nil {
+			return
+		}
 	}
+}
 
-	messageType, err := shared.MessageFromSocket(&clientConn)
-	if err != nil {
-		log.Printf("action: handle_client_connection | result: fail | error: %v", err)
-		shared.WriteSafe(clientConn, errorResponseSerialized)
-		return
-	}
+// messageHandler Answers a message of an agency. The message is always of
+// the type the handler is registered for in messageHandlers
+type messageHandler func(s *Server, ctx context.Context, message shared.Message, clientConn *shared.Conn)
+
+// messageHandlers Handler of each message type the agencies may send.
+// Any other type closes the connection
+var messageHandlers = map[shared.MessageType]messageHandler{
+	shared.BetType:             (*Server).handleBetMessage,
+	shared.BatchBetType:        (*Server).handleBatchBetMessage,
+	shared.AllBetsSentType:     (*Server).handleAllBetsSentMessage,
+	shared.ResultsQueryType:    (*Server).handleResultsQueryMessage,
+	shared.DocumentQueryType:   (*Server).handleDocumentQueryMessage,
+	shared.CancelBetType:       (*Server).handleCancelBetMessage,
+	shared.AmendBetType:        (*Server).handleAmendBetMessage,
+	shared.ServerInfoQueryType: (*Server).handleServerInfoQueryMessage,
+	shared.NumberedBatchType:   (*Server).handleNumberedBatchMessage,
+	shared.StatusQueryType:     (*Server).handleStatusQueryMessage,
+}
 
-	switch messageType.Type {
-	case shared.BetType:
-		s.handleBetMessage(messageType, clientConn)
-	case shared.BatchBetType:
-		s.handleBatchBetMessage(messageType, clientConn)
-	case shared.AllBetsSentType:
-		s.handleAllBetsSentMessage(messageType)
-	case shared.ResultsQueryType:
-		s.handleResultsQueryMessage(messageType, clientConn)
-	default:
-		log.Printf("action: handle_client_connection | result: fail | error: unknown message type %v", messageType.Type)
-		shared.WriteSafe(clientConn, errorResponseSerialized)
-		return
+// rejectMalformedMessage Answers a message that could not be deserialized
+// with an error. Messages that carry bets are recorded as rejected bets
+func (s *Server) rejectMalformedMessage(malformed *shared.MalformedMessageError, clientConn *shared.Conn) {
+	log.Printf("action: handle_client_connection | result: fail | message_type: %v | error: %v", malformed.Type, malformed.Err)
+	switch malformed.Type {
+	case shared.BetType, shared.BatchBetType, shared.NumberedBatchType:
+		s.recordAudit(audit.Entry{Event: audit.BetRejected, Detail: malformed.Err.Error()})
 	}
-
+	sendResponse(clientConn, shared.BetResponse{Success: false})
 }
 
-func (s *Server) handleBetMessage(message *shared.RawMessage, clientConn net.Conn) {
-
-	var betMessage shared.BetMessage
-	err := betMessage.Deserialize(message.Payload)
-	if err != nil {
-		log.Printf("action: handle_client_connection | result: fail | error: %v", err)
-		sendResponse(clientConn, shared.BetResponse(false))
-		return
-	}
-	bet := betMessage.ReceivedBet
-	s.betsMutex.Lock()
-	err = bets.StoreBets([]*bets.Bet{&bet})
-	s.betsMutex.Unlock()
+func (s *Server) handleBetMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	bet := message.(*shared.BetMessage).ReceivedBet
+	err := s.storeBets([]*bets.Bet{&bet}, nil)
 
 	if err != nil {
 		log.Printf("action: apuesta_almacenada | result: fail | error: %v", err)
-		sendResponse(clientConn, shared.BetResponse(false))
+		s.recordAudit(audit.Entry{Event: audit.BetRejected, Agency: bet.Agency, Detail: err.Error()})
+		sendResponse(clientConn, shared.BetResponse{Success: false})
 		return
 	}
 
 	log.Printf("action: apuesta_almacenada | result: success | dni: %v | numero: %v", bet.Document, bet.Number)
-	sendResponse(clientConn, shared.BetResponse(true))
+	sendResponse(clientConn, shared.BetResponse{Success: true, Tickets: []int64{bet.Ticket}})
 }
 
-func (s *Server) handleBatchBetMessage(message *shared.RawMessage, clientConn net.Conn) {
+func (s *Server) handleBatchBetMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	sendResponse(clientConn, s.receiveBatch(0, message.(*shared.BatchBetMessage).ReceivedBets, nil))
+}
 
-	var batchBetMessage shared.BatchBetMessage
-	err := batchBetMessage.Deserialize(message.Payload)
+// receiveBatch Stores the bets of a batch and returns the acknowledgement
+// for the agency. Nothing is stored if the server is busy, the batch
+// exceeds the limits or, when the agency that sent it is known, a bet is
+// for another agency. agency is 0 for messages that don't say who sent them.
+// storing is passed to storeBets
+func (s *Server) receiveBatch(agency int, received [][]string, storing func(firstTicket int64)) shared.BetResponse {
+	length := shared.BatchPayloadLength(received)
+	if !s.startBatch() {
+		log.Printf("action: apuesta_recibida | result: busy | bytes: %v", length)
+		return shared.BetResponse{Busy: true}
+	}
+	defer s.finishBatch()
+
+	limits := s.getBatchLimits()
+	var err error
+	if length > limits.MaxBytes {
+		err = fmt.Errorf("batch of %v bytes exceeds the limit of %v", length, limits.MaxBytes)
+	} else if len(received) > limits.MaxBets {
+		err = fmt.Errorf("batch of %v bets exceeds the limit of %v", len(received), limits.MaxBets)
+	} else if agency != 0 {
+		err = checkBatchAgency(agency, received)
+	}
 	if err != nil {
-		sendResponse(clientConn, shared.BetResponse(false))
-		return
+		log.Printf("action: apuesta_recibida | result: fail | agency: %v | error: %v", agency, err)
+		s.recordAudit(audit.Entry{Event: audit.BetRejected, Agency: agency, Detail: err.Error()})
+		return shared.BetResponse{Success: false}
 	}
 
 	var successfullBets []*bets.Bet
-	var errorCount int
+	var positions []int
+	var rejected []audit.Entry
 
-	for _, bet := range batchBetMessage.ReceivedBets {
-		number, err := strconv.Atoi(bet[5])
+	for i, bet := range received {
+		parsed, err := bets.ParseBet(bet)
 		if err != nil {
-			errorCount++
+			agency, _ := strconv.Atoi(bet[0])
+			rejected = append(rejected, audit.Entry{Event: audit.BetRejected, Agency: agency, Detail: fmt.Sprintf("batch line %v: %v", i+1, err)})
 			continue
 		}
-		bet, err := bets.NewBet(bet[0], bet[1], bet[2], bet[3], bet[4], number)
-		if err != nil {
-			errorCount++
-			continue
+
+		successfullBets = append(successfullBets, parsed)
+		positions = append(positions, i)
+	}
+	errorCount := len(rejected)
+	s.recordAudit(rejected...)
+
+	err = s.storeBets(successfullBets, storing)
+
+	if err != nil {
+		log.Printf("action: apuesta_almacenada | result: fail | error: %v", err)
+		for _, bet := range successfullBets {
+			rejected = append(rejected, audit.Entry{Event: audit.BetRejected, Agency: bet.Agency, Detail: err.Error()})
 		}
+		s.recordAudit(rejected[errorCount:]...)
+		return shared.BetResponse{Success: false}
+	}
 
-		successfullBets = append(successfullBets, bet)
+	tickets := make([]int64, len(received))
+	for i, bet := range successfullBets {
+		tickets[positions[i]] = bet.Ticket
 	}
 
 	if errorCount > 0 {
 		log.Printf("action: apuesta_recibida | result: fail | cantidad: %v", errorCount)
-		sendResponse(clientConn, shared.BetResponse(false))
-		err = bets.StoreBets(successfullBets)
+		return shared.BetResponse{Success: false, Tickets: tickets}
+	}
 
-		if err != nil {
-			log.Printf("action: apuesta_almacenada | result: fail | error: %v", err)
-			sendResponse(clientConn, shared.BetResponse(false))
-		}
+	log.Printf("action: apuesta_recibida | result: success | cantidad: %v", len(successfullBets))
 
-		return
+	return shared.BetResponse{Success: true, Tickets: tickets}
+}
+
+// handleServerInfoQueryMessage Tells the agency the batch sizes the server
+// prefers and accepts
+func (s *Server) handleServerInfoQueryMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	serverInfoQueryMessage := message.(*shared.ServerInfoQueryMessage)
+
+	limits := s.getBatchLimits()
+	response := shared.ServerInfoMessage{
+		PreferredBatchBytes: limits.PreferredBytes,
+		MaxBatchBytes:       limits.MaxBytes,
+		MaxBatchBets:        limits.MaxBets,
+	}
+	if _, err := clientConn.WriteMessage(&response); err != nil {
+		log.Printf("action: server_info | result: fail | agency: %v | error: %v", serverInfoQueryMessage.Agency, err)
 	}
+}
+
+// handleStatusQueryMessage Tells the agency how many of its bets are
+// stored, whether it already finished and whether the draw is closed
+func (s *Server) handleStatusQueryMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	agency := message.(*shared.StatusQueryMessage).Agency
 
+	response := shared.StatusMessage{TotalAgencies: s.getTotalAgencies()}
 	s.betsMutex.Lock()
-	err = bets.StoreBets(successfullBets)
+	response.BetsCommitted = s.betsCommitted[agency]
+	response.Finished = s.finishedAgencies[agency]
+	response.FinishedAgencies = len(s.finishedAgencies)
 	s.betsMutex.Unlock()
+	s.winnersMutex.Lock()
+	response.DrawClosed = s.winners != nil
+	s.winnersMutex.Unlock()
+
+	if _, err := clientConn.WriteMessage(&response); err != nil {
+		log.Printf("action: status | result: fail | agency: %v | error: %v", agency, err)
+	}
+}
 
+// recordAudit Appends entries to the audit log. A failure is logged but
+// doesn't stop the operation being audited
+func (s *Server) recordAudit(entries ...audit.Entry) {
+	if err := s.auditLog.Append(entries...); err != nil {
+		log.Printf("action: audit | result: fail | error: %v", err)
+	}
+}
+
+// storeBets Assigns a ticket to each bet, persists them and indexes them,
+// so the draw can be closed and the bets found without scanning the
+// storage. If storing is not nil it is called with betsMutex held and the
+// ticket of the first bet right before writing them
+func (s *Server) storeBets(received []*bets.Bet, storing func(firstTicket int64)) error {
+	s.betsMutex.Lock()
+	defer s.betsMutex.Unlock()
+	return s.storeBetsLocked(received, storing)
+}
+
+// storeBetsLocked Same as storeBets, with betsMutex already held
+func (s *Server) storeBetsLocked(received []*bets.Bet, storing func(firstTicket int64)) error {
+	if len(received) == 0 {
+		return nil
+	}
+	if s.drawFrozen {
+		return errors.New("draw already closed")
+	}
+	for i, bet := range received {
+		bet.Ticket = s.nextTicket + int64(i)
+	}
+	if storing != nil {
+		storing(s.nextTicket)
+	}
+	offsets, err := bets.AppendBets(received)
 	if err != nil {
-		log.Printf("action: apuesta_almacenada | result: fail | error: %v", err)
-		sendResponse(clientConn, shared.BetResponse(false))
-		return
+		return err
 	}
+	s.nextTicket += int64(len(received))
+	s.indexBets(received, offsets)
 
-	log.Printf("action: apuesta_recibida | result: success | cantidad: %v", len(successfullBets))
+	entries := make([]audit.Entry, 0, len(received))
+	for _, bet := range received {
+		entries = append(entries, audit.BetAcceptedEntry(bet))
+	}
+	s.recordAudit(entries...)
+	return nil
+}
 
-	sendResponse(clientConn, shared.BetResponse(true))
+// betLocation Agency of a stored bet and offset of its record in the
+// storage
+type betLocation struct {
+	agency int
+	offset int64
 }
 
-func sendResponse(conn net.Conn, response shared.BetResponse) error {
-	responseSerialized, _ := response.Serialize()
-	return shared.WriteSafe(conn, responseSerialized)
+// indexBets Keeps track of the winning bets of each agency, of the tickets
+// of each agency by document and of where every bet is stored, given the
+// offsets of their records. Must be called with betsMutex held once the
+// server is running
+func (s *Server) indexBets(stored []*bets.Bet, offsets []int64) {
+	for i, bet := range stored {
+		if bet.Ticket >= s.nextTicket {
+			s.nextTicket = bet.Ticket + 1
+		}
+		s.betLocations[bet.Ticket] = betLocation{agency: bet.Agency, offset: offsets[i]}
+		s.betsCommitted[bet.Agency]++
+		if bets.HasWon(bet) {
+			winning, ok := s.winningBets[bet.Agency]
+			if !ok {
+				winning = make(map[int64]string)
+				s.winningBets[bet.Agency] = winning
+			}
+			winning[bet.Ticket] = bet.Document
+		}
+		byDocument, ok := s.ticketsByDocument[bet.Agency]
+		if !ok {
+			byDocument = make(map[string][]int64)
+			s.ticketsByDocument[bet.Agency] = byDocument
+		}
+		byDocument[bet.Document] = append(byDocument[bet.Document], bet.Ticket)
+	}
 }
 
-func (s *Server) handleAllBetsSentMessage(message *shared.RawMessage) {
-	var allBetsSentMessage shared.AllBetsSentMessage
-	err := allBetsSentMessage.Deserialize(message.Payload)
-	if err != nil {
-		log.Printf("action: handle_all_bets_sent_message | result: fail | error: %v", err)
+// unindexBet Removes a cancelled bet from every index. Must be called with
+// betsMutex held
+func (s *Server) unindexBet(bet *bets.Bet) {
+	if _, ok := s.betLocations[bet.Ticket]; !ok {
 		return
 	}
-	s.receivedAgencies <- allBetsSentMessage.Agency
+	delete(s.betLocations, bet.Ticket)
+	s.betsCommitted[bet.Agency]--
+	delete(s.winningBets[bet.Agency], bet.Ticket)
+	tickets := s.ticketsByDocument[bet.Agency][bet.Document]
+	for i, ticket := range tickets {
+		if ticket == bet.Ticket {
+			s.ticketsByDocument[bet.Agency][bet.Document] = append(tickets[:i], tickets[i+1:]...)
+			break
+		}
+	}
 }
 
-func (s *Server) identifyWinners() {
+// checkBatchAgency Returns an error if a bet of a batch sent by agency is
+// for another agency. Bets whose agency can't be read are left to be
+// rejected on their own
+func checkBatchAgency(agency int, received [][]string) error {
+	for i, bet := range received {
+		if len(bet) == 0 {
+			continue
+		}
+		betAgency, err := strconv.Atoi(bet[0])
+		if err == nil && betAgency != agency {
+			return fmt.Errorf("batch line %v is a bet of agency %v, not of agency %v which sent it", i+1, betAgency, agency)
+		}
+	}
+	return nil
+}
+
+func sendResponse(conn *shared.Conn, response shared.BetResponse) error {
+	_, err := conn.WriteMessage(&response)
+	return err
+}
+
+// handleAllBetsSentMessage Hands the agency to identifyWinners. If the
+// server is shutting down the agency is marked as finished right away, so
+// it is kept in the draw state stored once the server is drained
+func (s *Server) handleAllBetsSentMessage(ctx context.Context, message shared.Message, _ *shared.Conn) {
+	allBetsSentMessage := message.(*shared.AllBetsSentMessage)
+	s.recordAudit(audit.Entry{Event: audit.AllBetsSent, Agency: allBetsSentMessage.Agency})
+	select {
+	case s.receivedAgencies <- allBetsSentMessage.Agency:
+	case <-s.drawClosed:
+		log.Printf("action: handle_all_bets_sent_message | result: ignored | agency: %v | reason: draw already closed", allBetsSentMessage.Agency)
+	case <-ctx.Done():
+		s.betsMutex.Lock()
+		s.finishedAgencies[allBetsSentMessage.Agency] = true
+		s.betsMutex.Unlock()
+	}
+}
+
+// identifyWinners Waits for every agency to finish, or for the draw
+// deadline, and closes the draw. Returns without closing it if ctx is
+// canceled first
+func (s *Server) identifyWinners(ctx context.Context) {
 	defer s.wg.Done()
-	receivedAgencies := make(map[int]bool)
-	for len(receivedAgencies) < s.totalAgencies {
-		agency := <-s.receivedAgencies
-		if agency == -1 {
+	deadlineReached := false
+	for !deadlineReached && s.finishedAmount() < s.getTotalAgencies() {
+		var deadline <-chan time.Time
+		timer := s.deadlineTimer()
+		if timer != nil {
+			deadline = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			stopTimer(timer)
 			log.Printf("action: identify_winners_shutdown | result: success")
 			return
+		case agency := <-s.receivedAgencies:
+			s.betsMutex.Lock()
+			alreadyFinished := s.finishedAgencies[agency]
+			s.finishedAgencies[agency] = true
+			state := bets.NewDrawState(s.finishedAgencies, nil)
+			s.betsMutex.Unlock()
+			if !alreadyFinished {
+				if err := bets.StoreDrawState(state); err != nil {
+					log.Printf("action: store_draw_state | result: fail | error: %v", err)
+				}
+			}
+		case <-s.settingsChanged:
+		case <-deadline:
+			log.Printf("action: draw_deadline | result: success | finished_agencies: %v | agencies: %v", s.finishedAmount(), s.getTotalAgencies())
+			deadlineReached = true
 		}
-		receivedAgencies[agency] = true
+		stopTimer(timer)
 	}
 	s.betsMutex.Lock()
-	loadedBets, err := bets.LoadBets()
-	s.betsMutex.Unlock()
-	if err != nil {
-		log.Printf("action: identificar_ganadores | result: fail | error: %v", err)
-		return
+	winners := make(map[int][]bets.Winner, len(s.winningBets))
+	for agency, documents := range s.winningBets {
+		agencyWinners := make([]bets.Winner, 0, len(documents))
+		for ticket, document := range documents {
+			agencyWinners = append(agencyWinners, bets.Winner{Ticket: ticket, Document: document})
+		}
+		sort.Slice(agencyWinners, func(i, j int) bool { return agencyWinners[i].Ticket < agencyWinners[j].Ticket })
+		winners[agency] = agencyWinners
 	}
+	s.drawFrozen = true
+	state := bets.NewDrawState(s.finishedAgencies, winners)
+	state.Agencies = s.getTotalAgencies()
+	results, err := report.Build(state.Agencies, s.finishedAgencies, bets.ForEach)
+	s.betsMutex.Unlock()
 
-	winners := make(map[int][]string)
-	for _, bet := range loadedBets {
-		if bets.HasWon(bet) {
-			winners[bet.Agency] = append(winners[bet.Agency], bet.Document)
+	if err := bets.StoreDrawState(state); err != nil {
+		log.Printf("action: store_draw_state | result: fail | error: %v", err)
+	}
+	winnersJSON, _ := json.Marshal(winners)
+	s.recordAudit(audit.Entry{
+		Event:  audit.DrawClosed,
+		Digest: shared.Digest(winnersJSON),
+		Detail: fmt.Sprintf("winning_number=%v", bets.LOTTERY_WINNER_NUMBER),
+	})
+
+	if err == nil {
+		var csvPath, jsonPath string
+		csvPath, jsonPath, err = results.Store(".")
+		if err == nil {
+			log.Printf("action: results_report | result: success | csv: %v | json: %v | missing_agencies: %v | unseen_agencies: %v", csvPath, jsonPath, results.MissingAgencies, results.UnseenAgencies)
 		}
 	}
+	if err != nil {
+		log.Printf("action: results_report | result: fail | error: %v", err)
+	}
 
 	s.winnersMutex.Lock()
 	s.winners = winners
 	s.winnersMutex.Unlock()
-
+	close(s.drawClosed)
 }
 
-func (s *Server) handleResultsQueryMessage(message *shared.RawMessage, clientConn net.Conn) {
-	var resultsQueryMessage shared.ResultsQueryMessage
-	err := resultsQueryMessage.Deserialize(message.Payload)
-	if err != nil {
-		log.Printf("action: handle_results_query_message | result: fail | error: %v", err)
-		return
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
 	}
+}
+
+func (s *Server) handleResultsQueryMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	resultsQueryMessage := message.(*shared.ResultsQueryMessage)
 	s.winnersMutex.Lock()
 	defer s.winnersMutex.Unlock()
 	if s.winners == nil {
-		message := shared.ResultUnavailableMessage{}
-		messageSerialized, _ := message.Serialize()
-		err := shared.WriteSafe(clientConn, messageSerialized)
+		s.recordAudit(audit.Entry{Event: audit.ResultsQuery, Agency: resultsQueryMessage.Agency, Detail: "unavailable"})
+		_, err := clientConn.WriteMessage(&shared.ResultUnavailableMessage{})
 		if err != nil {
 			log.Printf("action: handle_results_query_message | result: fail | error: %v", err)
 		}
@@ -284,6 +870,62 @@ func (s *Server) handleResultsQueryMessage(message *shared.RawMessage, clientCon
 	}
 	winners := s.winners[resultsQueryMessage.Agency]
 	response := shared.ResultsResponseMessage{Winners: winners}
-	responseSerialized, _ := response.Serialize()
-	shared.WriteSafe(clientConn, responseSerialized)
+	payload, _ := response.SerializePayload()
+	s.recordAudit(audit.Entry{
+		Event:  audit.ResultsQuery,
+		Agency: resultsQueryMessage.Agency,
+		Digest: shared.Digest(payload),
+		Detail: fmt.Sprintf("winners=%v", len(winners)),
+	})
+	clientConn.WriteMessage(&response)
+}
+
+// handleDocumentQueryMessage Answers with the bets a person placed at the
+// querying agency and the prize each one won. Bets taken by other agencies
+// are never returned
+func (s *Server) handleDocumentQueryMessage(_ context.Context, message shared.Message, clientConn *shared.Conn) {
+	documentQueryMessage := message.(*shared.DocumentQueryMessage)
+
+	select {
+	case <-s.drawClosed:
+	default:
+		s.recordAudit(audit.Entry{Event: audit.ResultsQuery, Agency: documentQueryMessage.Agency, Detail: "document | unavailable"})
+		if _, err := clientConn.WriteMessage(&shared.ResultUnavailableMessage{}); err != nil {
+			log.Printf("action: handle_document_query_message | result: fail | error: %v", err)
+		}
+		return
+	}
+
+	// The draw is closed, so the bets found can be read once the lock is
+	// released
+	s.betsMutex.Lock()
+	tickets := s.ticketsByDocument[documentQueryMessage.Agency][documentQueryMessage.Document]
+	locations := make(map[int64]betLocation, len(tickets))
+	for _, ticket := range tickets {
+		locations[ticket] = s.betLocations[ticket]
+	}
+	s.betsMutex.Unlock()
+
+	results := make([]shared.BetResult, 0, len(tickets))
+	for _, ticket := range tickets {
+		bet, err := bets.ReadBet(locations[ticket].offset, ticket)
+		if err != nil {
+			log.Printf("action: consulta_documento | result: fail | agency: %v | ticket: %v | error: %v", documentQueryMessage.Agency, ticket, err)
+			continue
+		}
+		results = append(results, shared.BetResult{Bet: *bet, Prize: bets.PrizeOf(bet)})
+	}
+
+	log.Printf("action: consulta_documento | result: success | agency: %v | cantidad: %v", documentQueryMessage.Agency, len(results))
+	response := shared.DocumentResultsMessage{Results: results}
+	payload, _ := response.SerializePayload()
+	s.recordAudit(audit.Entry{
+		Event:  audit.ResultsQuery,
+		Agency: documentQueryMessage.Agency,
+		Digest: shared.Digest(payload),
+		Detail: fmt.Sprintf("document | bets=%v", len(results)),
+	})
+	if _, err := clientConn.WriteMessage(&response); err != nil {
+		log.Printf("action: handle_document_query_message | result: fail | error: %v", err)
+	}
 }
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+// runWithPipe Runs a server in a temporary directory with an agency
+// connected through a pipe, answered as if the server had accepted it.
+// Writes to a pipe block until the other side reads them, so the test
+// knows when the server took a message. Returns the agency side of the
+// pipe, the function that starts draining the server and a channel closed
+// once it's drained
+func runWithPipe(t *testing.T) (*Server, *shared.Conn, context.CancelFunc, chan struct{}) {
+	inTempDir(t)
+	s, err := NewServer("127.0.0.1:0", 2, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// The pings would block on the pipe while the agency isn't reading
+	s.SetHeartbeat(0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(stopped)
+	}()
+
+	client, server := net.Pipe()
+	s.connectionsMutex.Lock()
+	s.connections[server.RemoteAddr().String()] = server
+	s.connectionsMutex.Unlock()
+	s.handlers.Add(1)
+	go s.handleClientConnection(ctx, server)
+
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-stopped
+	})
+	return s, shared.NewConn(client), cancel, stopped
+}
+
+func TestSilentAgencyIsReapedEvenIfItNeverPings(t *testing.T) {
+	s := startServer(t)
+	s.SetHeartbeat(10*time.Millisecond, 3)
+
+	// The agency connects and then never sends anything, not even a Pong, as
+	// if it died without closing the connection
+	conn, err := net.Dial("tcp", s.serverSocket.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.Copy(io.Discard, conn)
+	assert.NoError(t, err, "the server did not close the connection")
+	// The handler ends and leaves the open connections
+	assert.Eventually(t, func() bool {
+		s.connectionsMutex.Lock()
+		defer s.connectionsMutex.Unlock()
+		return len(s.connections) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDrainFinishesAndAcknowledgesTheBatchInFlight(t *testing.T) {
+	s, client, cancel, stopped := runWithPipe(t)
+
+	// The server takes the batch but can't store it while the stream of
+	// the agency is held
+	stream := s.batchStream(1)
+	stream.mutex.Lock()
+	_, err := client.WriteMessage(&shared.NumberedBatchMessage{Agency: 1, Session: 1, BatchID: 1, ReceivedBets: batchOf(1, 1)})
+	assert.NoError(t, err)
+	cancel()
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", s.serverSocket.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "the server kept accepting connections")
+	stream.mutex.Unlock()
+
+	message, err := client.ReadMessage()
+	assert.NoError(t, err)
+	ack := message.(*shared.BatchAckMessage)
+	assert.Equal(t, int64(1), ack.BatchID)
+	assert.Equal(t, []int64{1, 2}, ack.Response.Tickets)
+	<-stopped
+	assert.Equal(t, 2, storedBets(t))
+}
+
+func TestDrainClosesTheConnectionsStillOpenOnceTheGracePasses(t *testing.T) {
+	s, client, cancel, stopped := runWithPipe(t)
+	grace := 50 * time.Millisecond
+	s.SetShutdownGrace(grace)
+
+	// The agency never reads the acknowledgement, so the handler is stuck
+	// writing it
+	_, err := client.WriteMessage(&shared.NumberedBatchMessage{Agency: 1, Session: 1, BatchID: 1, ReceivedBets: batchOf(1)})
+	assert.NoError(t, err)
+	start := time.Now()
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server did not close the connection once the grace passed")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), grace)
+	assert.Equal(t, 1, storedBets(t))
+	s.connectionsMutex.Lock()
+	assert.Empty(t, s.connections)
+	s.connectionsMutex.Unlock()
+}
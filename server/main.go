@@ -1,73 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/config"
 	"github.com/op/go-logging"
-	"github.com/spf13/viper"
+	"github.com/spf13/pflag"
 )
 
-type Config struct {
-	Port           int
-	Ip             string
-	LoggingLevel   string
-	AgenciesAmount int
-}
-
 var log = logging.MustGetLogger("log")
 
-func InitConfig() (*Config, error) {
-	v := viper.New()
-
-	// Configure viper to read env variables with the CLI_ prefix
-	v.AutomaticEnv()
-	// Use a replacer to replace env variables underscores with points. This let us
-	// use nested configurations in the config file and at the same time define
-	// env variables for the nested configurations
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-
-	// Add env variables supported
-	v.BindEnv("default.server_port", "SERVER_PORT")
-	v.BindEnv("default.server_ip", "SERVER_IP")
-	v.BindEnv("default.logging_level", "LOGGING_LEVEL")
-	v.BindEnv("agencies_amount")
-	// Try to read configuration from config file. If config file
-	// does not exists then ReadInConfig will fail but configuration
-	// can be loaded from the environment variables so we shouldn't
-	// return an error in that case
-	v.SetConfigFile("./config.ini")
-	if err := v.ReadInConfig(); err != nil {
-		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
-	}
-
-	config := &Config{
-		Port:           v.GetInt("default.server_port"),
-		Ip:             v.GetString("default.server_ip"),
-		LoggingLevel:   v.GetString("default.logging_level"),
-		AgenciesAmount: v.GetInt("agencies_amount"),
-	}
-
-	if config.Port == 0 {
-		return nil, fmt.Errorf("port is not set")
-	}
-
-	if config.LoggingLevel == "" {
-		return nil, fmt.Errorf("logging_level is not set")
-	}
-
-	return config, nil
-}
+// loggerMutex Serializes InitLogger, which a config reload calls again
+// while the server runs
+var loggerMutex sync.Mutex
 
 // InitLogger Receives the log level to be set in go-logging as a string. This method
 // parses the string and set the level to the logger. If the level string is not
 // valid an error is returned
 func InitLogger(logLevel string) error {
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+
 	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
 	format := logging.MustStringFormatter(
 		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
@@ -88,48 +48,176 @@ func InitLogger(logLevel string) error {
 
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
-func PrintConfig(config *Config) {
-	log.Infof("action: config | result: success | port: %v | listen_backlog: os_default | logging_level: %s | agencies_amount: %v",
-		config.Port,
-		config.LoggingLevel,
-		config.AgenciesAmount,
+func PrintConfig(cfg *config.Server) {
+	log.Infof("action: config | result: success | port: %v | listen_backlog: os_default | logging_level: %s | agencies_amount: %v | max_connections: %v | draw_deadline: %v | batch_preferred_bytes: %v | batch_max_bytes: %v | max_pending_batches: %v | shutdown_grace: %v | heartbeat_interval: %v | heartbeat_misses: %v",
+		cfg.Port,
+		cfg.LoggingLevel,
+		cfg.AgenciesAmount,
+		cfg.MaxConnections,
+		cfg.DrawDeadline,
+		cfg.BatchPreferredBytes,
+		cfg.BatchMaxBytes,
+		cfg.MaxPendingBatches,
+		cfg.ShutdownGrace,
+		cfg.HeartbeatInterval,
+		cfg.HeartbeatMisses,
 	)
 }
 
-func gracefulShutdown(s *common.Server, wg *sync.WaitGroup) {
-	defer wg.Done()
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGTERM)
-	<-quit
-	s.Shutdown()
+// batchLimits Batch limits the server applies with the given configuration
+func batchLimits(cfg *config.Server) common.BatchLimits {
+	return common.BatchLimits{
+		PreferredBytes: cfg.BatchPreferredBytes,
+		MaxBytes:       cfg.BatchMaxBytes,
+		MaxBets:        config.MaxBatchAmount,
+		MaxPending:     cfg.MaxPendingBatches,
+	}
 }
 
-func main() {
-	config, err := InitConfig()
+// reloadConfig Loads the configuration again and applies the settings that
+// can change while the server is running. Settings that need a restart are
+// rejected with a log line and keep their current value
+func reloadConfig(s *common.Server, current *config.Server, args []string) *config.Server {
+	next, _, err := config.LoadServer(args)
 	if err != nil {
-		log.Errorf("error initializing config: %v", err)
+		log.Errorf("action: reload_config | result: fail | error: %v", err)
+		return current
+	}
 
+	if next.Port != current.Port {
+		log.Errorf("action: reload_config | result: rejected | setting: server_port | current: %v | requested: %v | reason: requires a restart",
+			current.Port, next.Port)
+		next.Port = current.Port
+	}
+	if next.Ip != current.Ip {
+		log.Errorf("action: reload_config | result: rejected | setting: server_ip | current: %v | requested: %v | reason: requires a restart",
+			current.Ip, next.Ip)
+		next.Ip = current.Ip
+	}
+	if next.LoggingLevel != current.LoggingLevel {
+		if err := InitLogger(next.LoggingLevel); err != nil {
+			log.Errorf("action: reload_config | result: rejected | setting: logging_level | error: %v", err)
+			next.LoggingLevel = current.LoggingLevel
+		}
+	}
+	if next.AgenciesAmount != current.AgenciesAmount {
+		s.SetAgenciesAmount(next.AgenciesAmount)
+	}
+	if next.MaxConnections != current.MaxConnections {
+		s.SetMaxConnections(next.MaxConnections)
+	}
+	if next.DrawDeadline != current.DrawDeadline {
+		s.SetDrawDeadline(next.DrawDeadline)
+	}
+	if batchLimits(next) != batchLimits(current) {
+		s.SetBatchLimits(batchLimits(next))
+	}
+	if next.ShutdownGrace != current.ShutdownGrace {
+		s.SetShutdownGrace(next.ShutdownGrace)
 	}
+	if next.HeartbeatInterval != current.HeartbeatInterval || next.HeartbeatMisses != current.HeartbeatMisses {
+		s.SetHeartbeat(next.HeartbeatInterval, next.HeartbeatMisses)
+	}
+
+	log.Infof("action: reload_config | result: success | logging_level: %s | agencies_amount: %v | max_connections: %v | draw_deadline: %v | batch_preferred_bytes: %v | batch_max_bytes: %v | max_pending_batches: %v | shutdown_grace: %v | heartbeat_interval: %v | heartbeat_misses: %v",
+		next.LoggingLevel,
+		next.AgenciesAmount,
+		next.MaxConnections,
+		next.DrawDeadline,
+		next.BatchPreferredBytes,
+		next.BatchMaxBytes,
+		next.MaxPendingBatches,
+		next.ShutdownGrace,
+		next.HeartbeatInterval,
+		next.HeartbeatMisses,
+	)
+	return next
+}
 
-	PrintConfig(config)
+// reloadTriggers Events that make the server reload its configuration
+type reloadTriggers struct {
+	hangup      chan os.Signal
+	fileChanged chan struct{}
+}
 
-	if err := InitLogger(config.LoggingLevel); err != nil {
-		log.Errorf("error initializing logger: %v", err)
-		return
+// watchReloadTriggers Starts listening for SIGHUP and for writes to the
+// config file. It must be called before the server runs, as a SIGHUP
+// received before it's registered terminates the process
+func watchReloadTriggers(configFile string) *reloadTriggers {
+	triggers := &reloadTriggers{
+		hangup:      make(chan os.Signal, 1),
+		fileChanged: make(chan struct{}, 1),
+	}
+	signal.Notify(triggers.hangup, syscall.SIGHUP)
+	config.WatchConfigFile(configFile, func() {
+		select {
+		case triggers.fileChanged <- struct{}{}:
+		default:
+		}
+	})
+	return triggers
+}
+
+// reloadOnChange Reloads the configuration every time one of the triggers
+// fires
+func reloadOnChange(s *common.Server, cfg *config.Server, args []string, triggers *reloadTriggers) {
+	for {
+		select {
+		case <-triggers.hangup:
+			log.Infof("action: reload_config | result: in_progress | reason: SIGHUP")
+		case <-triggers.fileChanged:
+			log.Infof("action: reload_config | result: in_progress | reason: config file changed")
+		}
+		cfg = reloadConfig(s, cfg, args)
+	}
+}
 
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
 	}
 
-	server, err := common.NewServer(fmt.Sprintf("%s:%d", config.Ip, config.Port), config.AgenciesAmount)
+	cfg, mode, err := config.LoadServer(os.Args[1:])
+	if errors.Is(err, pflag.ErrHelp) {
+		return
+	}
+	if mode == config.PrintMode && cfg != nil {
+		cfg.Print(os.Stdout)
+	}
 	if err != nil {
-		log.Errorf("error initializing server: %v", err)
+		fmt.Fprintf(os.Stderr, "error initializing config: %v\n", err)
+		os.Exit(1)
+	}
+	if mode == config.CheckMode {
+		fmt.Println("configuration is valid")
+	}
+	if mode != config.RunMode {
 		return
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go gracefulShutdown(server, &wg)
-	server.Run()
+	if err := InitLogger(cfg.LoggingLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "error initializing logger: %v\n", err)
+		os.Exit(1)
+	}
 
-	wg.Wait()
+	PrintConfig(cfg)
 
+	server, err := common.NewServer(fmt.Sprintf("%s:%d", cfg.Ip, cfg.Port), cfg.AgenciesAmount, cfg.MaxConnections)
+	if err != nil {
+		log.Errorf("error initializing server: %v", err)
+		return
+	}
+	server.SetDrawDeadline(cfg.DrawDeadline)
+	server.SetBatchLimits(batchLimits(cfg))
+	server.SetShutdownGrace(cfg.ShutdownGrace)
+	server.SetHeartbeat(cfg.HeartbeatInterval, cfg.HeartbeatMisses)
+
+	// SIGTERM cancels ctx, which makes the server drain and Run return
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	triggers := watchReloadTriggers(cfg.ConfigFile)
+	go reloadOnChange(server, cfg, os.Args[1:], triggers)
+	server.Run(ctx)
 }
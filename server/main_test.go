@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/shared/config"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, path string, content string) {
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestReloadConfigAppliesTheSettingsThatDontNeedARestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	writeConfigFile(t, path, "[DEFAULT]\nSERVER_PORT = 1000\nSERVER_IP = server\nLOGGING_LEVEL = INFO\n")
+	t.Setenv("AGENCIES_AMOUNT", "2")
+	args := []string{"--config", path}
+	current, _, err := config.LoadServer(args)
+	assert.NoError(t, err)
+	assert.NoError(t, InitLogger(current.LoggingLevel))
+	s, err := common.NewServer("127.0.0.1:0", current.AgenciesAmount, current.MaxConnections)
+	assert.NoError(t, err)
+
+	writeConfigFile(t, path, "[DEFAULT]\nSERVER_PORT = 2000\nSERVER_IP = server\nLOGGING_LEVEL = DEBUG\nMAX_CONNECTIONS = 3\n")
+	t.Setenv("AGENCIES_AMOUNT", "5")
+	next := reloadConfig(s, current, args)
+	assert.Equal(t, 1000, next.Port, "the port needs a restart")
+	assert.Equal(t, 5, next.AgenciesAmount)
+	assert.Equal(t, 3, next.MaxConnections)
+	assert.Equal(t, logging.DEBUG, logging.GetLevel(""))
+
+	// An invalid file keeps the configuration as it was
+	writeConfigFile(t, path, "[DEFAULT]\nSERVER_PORT = -1\n")
+	assert.Same(t, next, reloadConfig(s, next, args))
+}
+
+func TestSighupReloadsInsteadOfTerminating(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	writeConfigFile(t, path, "[DEFAULT]\n")
+	triggers := watchReloadTriggers(path)
+	defer signal.Stop(triggers.hangup)
+
+	// Without the handler registered this would terminate the test binary
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case <-triggers.hangup:
+	case <-time.After(time.Second):
+		t.Fatal("SIGHUP was not received")
+	}
+}
@@ -0,0 +1,205 @@
+// Package report builds the results report of a closed draw: bet totals
+// per agency, the winning tickets with who placed them, the agencies that
+// did not finish sending their bets before the draw closed, how many of the
+// expected agencies were never heard of and the winning number. It is
+// written as CSV and as JSON.
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+)
+
+const CSV_FILENAME = "results_report.csv"
+const JSON_FILENAME = "results_report.json"
+
+// AgencyTotals Bets taken by an agency and how many of them won
+type AgencyTotals struct {
+	Agency   int   `json:"agency"`
+	Bets     int64 `json:"bets"`
+	Winners  int64 `json:"winners"`
+	Finished bool  `json:"finished"`
+}
+
+// WinningTicket A winning bet and who placed it
+type WinningTicket struct {
+	Ticket    int64  `json:"ticket"`
+	Agency    int    `json:"agency"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Document  string `json:"document"`
+	Prize     string `json:"prize"`
+}
+
+// Report Results of a closed draw
+type Report struct {
+	GeneratedAt     time.Time      `json:"generated_at"`
+	WinningNumber   int            `json:"winning_number"`
+	TotalBets       int64          `json:"total_bets"`
+	Agencies        []AgencyTotals `json:"agencies"`
+	MissingAgencies []int          `json:"missing_agencies"`
+	// UnseenAgencies Agencies the draw expected of which no bet was stored
+	// and that did not finish either, so they can't be named
+	UnseenAgencies int             `json:"unseen_agencies"`
+	Winners        []WinningTicket `json:"winners"`
+}
+
+// Build Builds the report of a draw that expected agenciesAmount agencies,
+// of which the ones in finished sent all their bets. Agencies are known by
+// their bets or by having finished, whatever their IDs are. forEach must
+// visit every bet that took part in the draw, like bets.ForEach
+func Build(agenciesAmount int, finished map[int]bool, forEach func(func(*bets.Bet) error) error) (*Report, error) {
+	totals := make(map[int]*AgencyTotals)
+	agencyTotals := func(agency int) *AgencyTotals {
+		agencyTotals, ok := totals[agency]
+		if !ok {
+			agencyTotals = &AgencyTotals{Agency: agency, Finished: finished[agency]}
+			totals[agency] = agencyTotals
+		}
+		return agencyTotals
+	}
+	for agency := range finished {
+		agencyTotals(agency)
+	}
+
+	report := &Report{
+		GeneratedAt:     time.Now().UTC(),
+		WinningNumber:   bets.LOTTERY_WINNER_NUMBER,
+		MissingAgencies: []int{},
+		Winners:         []WinningTicket{},
+	}
+	err := forEach(func(bet *bets.Bet) error {
+		agencyTotals := agencyTotals(bet.Agency)
+		agencyTotals.Bets++
+		report.TotalBets++
+		prize := bets.PrizeOf(bet)
+		if prize == bets.NoPrize {
+			return nil
+		}
+		agencyTotals.Winners++
+		report.Winners = append(report.Winners, WinningTicket{
+			Ticket:    bet.Ticket,
+			Agency:    bet.Agency,
+			FirstName: bet.FirstName,
+			LastName:  bet.LastName,
+			Document:  bet.Document,
+			Prize:     prize.String(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading bets: %v", err)
+	}
+
+	report.Agencies = make([]AgencyTotals, 0, len(totals))
+	for _, agencyTotals := range totals {
+		report.Agencies = append(report.Agencies, *agencyTotals)
+	}
+	sort.Slice(report.Agencies, func(i, j int) bool { return report.Agencies[i].Agency < report.Agencies[j].Agency })
+	for _, agencyTotals := range report.Agencies {
+		if !agencyTotals.Finished {
+			report.MissingAgencies = append(report.MissingAgencies, agencyTotals.Agency)
+		}
+	}
+	if unseen := agenciesAmount - len(report.Agencies); unseen > 0 {
+		report.UnseenAgencies = unseen
+	}
+	sort.Slice(report.Winners, func(i, j int) bool { return report.Winners[i].Ticket < report.Winners[j].Ticket })
+	return report, nil
+}
+
+// WriteJSON Writes the report as an indented JSON document
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r); err != nil {
+		return fmt.Errorf("error encoding report: %v", err)
+	}
+	return nil
+}
+
+// WriteCSV Writes the report as CSV. It has three sections separated by an
+// empty line, each one starting with its own header: the draw summary, the
+// totals per agency and the winning tickets
+func (r *Report) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	missing := make([]string, 0, len(r.MissingAgencies))
+	for _, agency := range r.MissingAgencies {
+		missing = append(missing, strconv.Itoa(agency))
+	}
+	records := [][]string{
+		{"generated_at", "winning_number", "total_bets", "missing_agencies", "unseen_agencies"},
+		{r.GeneratedAt.Format(time.RFC3339), strconv.Itoa(r.WinningNumber), strconv.FormatInt(r.TotalBets, 10), strings.Join(missing, " "), strconv.Itoa(r.UnseenAgencies)},
+		nil,
+		{"agency", "bets", "winners", "finished"},
+	}
+	for _, agencyTotals := range r.Agencies {
+		records = append(records, []string{
+			strconv.Itoa(agencyTotals.Agency),
+			strconv.FormatInt(agencyTotals.Bets, 10),
+			strconv.FormatInt(agencyTotals.Winners, 10),
+			strconv.FormatBool(agencyTotals.Finished),
+		})
+	}
+	records = append(records, nil, []string{"ticket", "agency", "first_name", "last_name", "document", "prize"})
+	for _, winner := range r.Winners {
+		records = append(records, []string{
+			strconv.FormatInt(winner.Ticket, 10),
+			strconv.Itoa(winner.Agency),
+			winner.FirstName,
+			winner.LastName,
+			winner.Document,
+			winner.Prize,
+		})
+	}
+
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("error writing record: %v", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error writing record: %v", err)
+	}
+	return nil
+}
+
+// Store Writes the report to CSV_FILENAME and JSON_FILENAME inside dir and
+// returns their paths
+func (r *Report) Store(dir string) (string, string, error) {
+	csvPath := filepath.Join(dir, CSV_FILENAME)
+	jsonPath := filepath.Join(dir, JSON_FILENAME)
+	if err := writeFile(csvPath, r.WriteCSV); err != nil {
+		return "", "", err
+	}
+	if err := writeFile(jsonPath, r.WriteJSON); err != nil {
+		return "", "", err
+	}
+	return csvPath, jsonPath, nil
+}
+
+func writeFile(path string, write func(io.Writer) error) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
+	return nil
+}
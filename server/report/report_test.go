@@ -0,0 +1,74 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/stretchr/testify/assert"
+)
+
+func forEachOf(stored []*bets.Bet) func(func(*bets.Bet) error) error {
+	return func(fn func(*bets.Bet) error) error {
+		for _, bet := range stored {
+			if err := fn(bet); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestBuildCountsBetsListsWinnersAndMissingAgencies(t *testing.T) {
+	winner, _ := bets.NewBet("2", "first", "last", "10000000", "2000-12-20", bets.LOTTERY_WINNER_NUMBER)
+	winner.Ticket = 3
+	loser, _ := bets.NewBet("1", "other", "last", "20000000", "2000-12-20", 1)
+	loser.Ticket = 1
+	another, _ := bets.NewBet("2", "another", "last", "30000000", "2000-12-20", 2)
+	another.Ticket = 2
+
+	report, err := Build(3, map[int]bool{1: true}, forEachOf([]*bets.Bet{winner, loser, another}))
+	assert.NoError(t, err)
+	assert.Equal(t, bets.LOTTERY_WINNER_NUMBER, report.WinningNumber)
+	assert.Equal(t, int64(3), report.TotalBets)
+	assert.Equal(t, []AgencyTotals{
+		{Agency: 1, Bets: 1, Winners: 0, Finished: true},
+		{Agency: 2, Bets: 2, Winners: 1, Finished: false},
+	}, report.Agencies)
+	assert.Equal(t, []int{2}, report.MissingAgencies)
+	assert.Equal(t, 1, report.UnseenAgencies)
+	assert.Equal(t, []WinningTicket{
+		{Ticket: 3, Agency: 2, FirstName: "first", LastName: "last", Document: "10000000", Prize: "first"},
+	}, report.Winners)
+}
+
+func TestWriteCSVWritesEverySection(t *testing.T) {
+	winner, _ := bets.NewBet("1", "first", "last", "10000000", "2000-12-20", bets.LOTTERY_WINNER_NUMBER)
+	winner.Ticket = 1
+	report, err := Build(2, map[int]bool{1: true}, forEachOf([]*bets.Bet{winner}))
+	assert.NoError(t, err)
+
+	var buffer bytes.Buffer
+	assert.NoError(t, report.WriteCSV(&buffer))
+	sections := strings.Split(buffer.String(), "\n\n")
+	assert.Len(t, sections, 3)
+	assert.True(t, strings.HasSuffix(strings.Split(sections[0], "\n")[1], ",7574,1,,1"))
+	assert.Equal(t, "agency,bets,winners,finished\n1,1,1,true", sections[1])
+	assert.Equal(t, "ticket,agency,first_name,last_name,document,prize\n1,1,first,last,10000000,first\n", sections[2])
+}
+
+func TestMissingAgenciesAreTheOnesSeenThatDidNotFinish(t *testing.T) {
+	first, _ := bets.NewBet("1", "first", "last", "10000000", "2000-12-20", 1)
+	fourth, _ := bets.NewBet("4", "fourth", "last", "40000000", "2000-12-20", 2)
+
+	report, err := Build(2, map[int]bool{1: true, 4: true}, forEachOf([]*bets.Bet{first, fourth}))
+	assert.NoError(t, err)
+	assert.Empty(t, report.MissingAgencies)
+	assert.Equal(t, 0, report.UnseenAgencies)
+
+	report, err = Build(2, map[int]bool{1: true}, forEachOf([]*bets.Bet{first, fourth}))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{4}, report.MissingAgencies)
+	assert.Equal(t, 0, report.UnseenAgencies)
+}
@@ -0,0 +1,300 @@
+package shared
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+// HeaderLength Size of the type and length fields that precede every payload
+const HeaderLength = 8
+
+// ChecksumLength Size of the CRC32C trailer that follows the payload of the
+// frames with checksumFlag set
+const ChecksumLength = 4
+
+// checksumFlag Bit of the type field set on the frames that carry a
+// checksum trailer
+const checksumFlag = 1 << 31
+
+// compressedFlag Bit of the type field set on the frames whose payload is
+// compressed with flate
+const compressedFlag = 1 << 30
+
+// DefaultCompressionThreshold Smallest payload compressed by a connection
+// that enables compression because its peer sent a compressed frame
+const DefaultCompressionThreshold = 1024
+
+// MaxPayloadLength Largest payload a frame may announce. A larger length
+// is taken as a corrupted header instead of being allocated
+const MaxPayloadLength = 64 << 20
+
+// castagnoli Table of the CRC32C polynomial used by the frame trailers
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrUnknownMessageType A message whose type has no registered constructor
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// ErrFrameTooLarge A frame that announces a payload above MaxPayloadLength
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ErrDecompressedTooLarge A compressed payload that expands beyond the
+// limit of the connection
+var ErrDecompressedTooLarge = errors.New("decompressed payload too large")
+
+// compressibleTypes Messages whose payload is compressed if it reaches the
+// compression threshold of the connection
+var compressibleTypes = map[MessageType]bool{
+	BatchBetType:      true,
+	NumberedBatchType: true,
+}
+
+// frameOptions How the frames of a connection are written
+type frameOptions struct {
+	checksum bool
+	// compress Whether compressible payloads of at least compressThreshold
+	// bytes are compressed
+	compress          bool
+	compressThreshold int
+}
+
+// ChecksumMismatchError A frame whose trailer doesn't match the CRC32C of
+// its header and payload. The frame was read whole, so if only its content
+// was corrupted the connection is still in sync
+type ChecksumMismatchError struct {
+	Type     MessageType
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch on message of type %v: expected %08x, got %08x", e.Type, e.Expected, e.Actual)
+}
+
+// MalformedMessageError A message that was read whole but whose payload
+// could not be deserialized. The connection is still in sync, so the next
+// message can be read
+type MalformedMessageError struct {
+	Type MessageType
+	Err  error
+}
+
+func (e *MalformedMessageError) Error() string {
+	return fmt.Sprintf("malformed message of type %v: %v", e.Type, e.Err)
+}
+
+func (e *MalformedMessageError) Unwrap() error {
+	return e.Err
+}
+
+// registry Constructor of an empty message of each registered type
+var registry = make(map[MessageType]func() Message)
+
+// Register Makes ReadMessage deserialize the messages of the given type into
+// the ones newMessage returns. Registering a type twice is a programming
+// error and panics
+func Register(messageType MessageType, newMessage func() Message) {
+	if _, ok := registry[messageType]; ok {
+		panic(fmt.Sprintf("message type %v registered twice", messageType))
+	}
+	registry[messageType] = newMessage
+}
+
+type RawMessage struct {
+	Type MessageType
+	// Length Size of the payload as it was sent, compressed or not
+	Length  int
+	Payload []byte
+	// Checksum Whether the frame carried a checksum trailer, which was
+	// already verified
+	Checksum bool
+	// Compressed Whether the payload was sent compressed. Payload is
+	// already decompressed
+	Compressed bool
+}
+
+// Decode Returns the message the raw message carries
+func (m *RawMessage) Decode() (Message, error) {
+	newMessage, ok := registry[m.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %v", ErrUnknownMessageType, m.Type)
+	}
+	message := newMessage()
+	if err := message.Deserialize(m.Payload); err != nil {
+		return nil, &MalformedMessageError{Type: m.Type, Err: err}
+	}
+	return message, nil
+}
+
+// readRawMessage Reads exactly one message of r, so it can be called again
+// for the next one. If the frame has a checksum trailer it is verified, and
+// if its payload is compressed it is decompressed up to maxDecompressed
+// bytes
+func readRawMessage(r io.Reader, maxDecompressed int) (*RawMessage, error) {
+	header := make([]byte, HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	typeField := binary.BigEndian.Uint32(header[:4])
+	messageLength := binary.BigEndian.Uint32(header[4:])
+	if messageLength > MaxPayloadLength {
+		return nil, fmt.Errorf("%w: %v bytes", ErrFrameTooLarge, messageLength)
+	}
+	payload := make([]byte, messageLength)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	message := &RawMessage{
+		Type:       MessageType(typeField &^ (checksumFlag | compressedFlag)),
+		Length:     int(messageLength),
+		Payload:    payload,
+		Checksum:   typeField&checksumFlag != 0,
+		Compressed: typeField&compressedFlag != 0,
+	}
+	if message.Checksum {
+		trailer := make([]byte, ChecksumLength)
+		if _, err := io.ReadFull(r, trailer); err != nil {
+			return nil, err
+		}
+		digest := crc32.New(castagnoli)
+		digest.Write(header)
+		digest.Write(payload)
+		expected := binary.BigEndian.Uint32(trailer)
+		if actual := digest.Sum32(); actual != expected {
+			return nil, &ChecksumMismatchError{Type: message.Type, Expected: expected, Actual: actual}
+		}
+	}
+	if message.Compressed {
+		decompressed, err := decompress(payload, maxDecompressed)
+		if errors.Is(err, ErrDecompressedTooLarge) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, &MalformedMessageError{Type: message.Type, Err: err}
+		}
+		message.Payload = decompressed
+	}
+	return message, nil
+}
+
+// compress Returns the payload compressed with flate
+func compress(payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decompress Returns the payload decompressed with flate. It stops reading
+// once the payload goes over limit bytes, so a small frame can't make the
+// receiver allocate an arbitrary amount of memory
+func decompress(compressed []byte, limit int) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+	payload, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing payload: %v", err)
+	}
+	if len(payload) > limit {
+		return nil, fmt.Errorf("%w: more than %v bytes", ErrDecompressedTooLarge, limit)
+	}
+	return payload, nil
+}
+
+// MessageFromSocket Reads the next message of the connection. It reads
+// exactly one message, so it can be called again for the next one
+func MessageFromSocket(socket *net.Conn) (*RawMessage, error) {
+	return readRawMessage(*socket, MaxPayloadLength)
+}
+
+// ReadMessage Reads the next message of r and deserializes it with the
+// constructor registered for its type
+func ReadMessage(r io.Reader) (Message, error) {
+	raw, err := readRawMessage(r, MaxPayloadLength)
+	if err != nil {
+		return nil, err
+	}
+	return raw.Decode()
+}
+
+// ReadMessageContext Same as ReadMessage, but the read fails once ctx is
+// done or its deadline passes
+func ReadMessageContext(ctx context.Context, conn net.Conn) (Message, error) {
+	raw, err := MessageFromSocketContext(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return raw.Decode()
+}
+
+// Serialize Returns the message preceded by its header, as it is sent
+// on a connection without checksums nor compression
+func Serialize(message Message) ([]byte, error) {
+	return encodeFrame(message, frameOptions{})
+}
+
+// encodeFrame Returns the message preceded by its header and, if the
+// options ask for a checksum, followed by the CRC32C of both. The payload
+// is only sent compressed if that makes it smaller
+func encodeFrame(message Message, options frameOptions) ([]byte, error) {
+	payload, err := message.SerializePayload()
+	if err != nil {
+		return nil, err
+	}
+	typeField := uint32(message.GetMessageType())
+	if options.compress && compressibleTypes[message.GetMessageType()] && len(payload) >= options.compressThreshold {
+		compressed, err := compress(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(payload) {
+			payload = compressed
+			typeField |= compressedFlag
+		}
+	}
+	if options.checksum {
+		typeField |= checksumFlag
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, HeaderLength+len(payload)+ChecksumLength))
+	binary.Write(buffer, binary.BigEndian, typeField)
+	binary.Write(buffer, binary.BigEndian, uint32(len(payload)))
+	buffer.Write(payload)
+	if options.checksum {
+		binary.Write(buffer, binary.BigEndian, crc32.Checksum(buffer.Bytes(), castagnoli))
+	}
+	return buffer.Bytes(), nil
+}
+
+// WriteMessage Writes the message preceded by its header to w
+func WriteMessage(w io.Writer, message Message) error {
+	serialized, err := Serialize(message)
+	if err != nil {
+		return err
+	}
+	return WriteSafe(w, serialized)
+}
+
+// WriteMessageContext Same as WriteMessage, but the write fails once ctx is
+// done or its deadline passes
+func WriteMessageContext(ctx context.Context, conn net.Conn, message Message) error {
+	serialized, err := Serialize(message)
+	if err != nil {
+		return err
+	}
+	return WriteSafeContext(ctx, conn, serialized)
+}
@@ -1,12 +1,9 @@
 package shared
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
-	"net"
 	"strconv"
 	"strings"
 
@@ -23,31 +20,69 @@ const (
 	ResultsQueryType
 	ResultUnavailableType
 	ResultsResponseType
+	DocumentQueryType
+	DocumentResultsType
+	CancelBetType
+	AmendBetType
+	ServerInfoQueryType
+	ServerInfoType
+	NumberedBatchType
+	BatchAckType
+	StatusQueryType
+	StatusType
+	ChecksumErrorType
+	PingType
+	PongType
 )
 
+func init() {
+	Register(BetType, func() Message { return &BetMessage{} })
+	Register(BetResponseType, func() Message { return &BetResponse{} })
+	Register(BatchBetType, func() Message { return &BatchBetMessage{} })
+	Register(AllBetsSentType, func() Message { return &AllBetsSentMessage{} })
+	Register(ResultsQueryType, func() Message { return &ResultsQueryMessage{} })
+	Register(ResultUnavailableType, func() Message { return &ResultUnavailableMessage{} })
+	Register(ResultsResponseType, func() Message { return &ResultsResponseMessage{} })
+	Register(DocumentQueryType, func() Message { return &DocumentQueryMessage{} })
+	Register(DocumentResultsType, func() Message { return &DocumentResultsMessage{} })
+	Register(CancelBetType, func() Message { return &CancelBetMessage{} })
+	Register(AmendBetType, func() Message { return &AmendBetMessage{} })
+	Register(ServerInfoQueryType, func() Message { return &ServerInfoQueryMessage{} })
+	Register(ServerInfoType, func() Message { return &ServerInfoMessage{} })
+	Register(NumberedBatchType, func() Message { return &NumberedBatchMessage{} })
+	Register(BatchAckType, func() Message { return &BatchAckMessage{} })
+	Register(StatusQueryType, func() Message { return &StatusQueryMessage{} })
+	Register(StatusType, func() Message { return &StatusMessage{} })
+	Register(ChecksumErrorType, func() Message { return &ChecksumErrorMessage{} })
+	Register(PingType, func() Message { return &PingMessage{} })
+	Register(PongType, func() Message { return &PongMessage{} })
+}
+
+// Message A message of the protocol. It only encodes its payload, the
+// codec adds the header with its type and length
 type Message interface {
-	Serialize() ([]byte, error)
+	GetMessageType() MessageType
+	SerializePayload() ([]byte, error)
 	Deserialize(data []byte) error
 }
 
 type BetMessage struct {
-	Message
 	ReceivedBet bets.Bet
 }
 
-func (m *BetMessage) Serialize() ([]byte, error) {
-	payload := []byte(fmt.Sprintf("%v;%v;%v;%v;%v;%v", m.ReceivedBet.Agency, m.ReceivedBet.FirstName, m.ReceivedBet.LastName, m.ReceivedBet.Document, m.ReceivedBet.BirthDate.Format("2006-01-02"), m.ReceivedBet.Number))
-	buffer := bytes.NewBuffer([]byte{})
-
-	binary.Write(buffer, binary.BigEndian, uint32(BetType))
-	binary.Write(buffer, binary.BigEndian, uint32(len(payload)))
+func (m *BetMessage) GetMessageType() MessageType {
+	return BetType
+}
 
-	buffer.Write(payload)
-	return buffer.Bytes(), nil
+func (m *BetMessage) SerializePayload() ([]byte, error) {
+	return []byte(fmt.Sprintf("%v;%v;%v;%v;%v;%v", m.ReceivedBet.Agency, m.ReceivedBet.FirstName, m.ReceivedBet.LastName, m.ReceivedBet.Document, m.ReceivedBet.BirthDate.Format("2006-01-02"), m.ReceivedBet.Number)), nil
 }
 
-func (m *BetMessage) Deserialize(data string) error {
-	parts := strings.Split(data, ";")
+func (m *BetMessage) Deserialize(data []byte) error {
+	parts := strings.Split(string(data), ";")
+	if len(parts) != 6 {
+		return fmt.Errorf("bet message must have 6 fields, got %v", len(parts))
+	}
 	number, err := strconv.Atoi(parts[5])
 	if err != nil {
 		return err
@@ -62,187 +97,618 @@ func (m *BetMessage) Deserialize(data string) error {
 	return nil
 }
 
-type BetResponse bool
-
-func (m *BetResponse) Serialize() ([]byte, error) {
-	var payload string
-	if *m {
-		payload = "SUCCESS"
-	} else {
-		payload = "ERROR"
-	}
+// BetResponse Acknowledgement of a bet, batch, cancellation or amendment.
+// Tickets holds the ticket the server assigned to each received bet, in the
+// same order, with 0 for the bets that were rejected. Busy means the server
+// did not process the message because it is overloaded, it can be sent
+// again later
+type BetResponse struct {
+	Success bool
+	Busy    bool
+	Tickets []int64
+}
 
-	buffer := bytes.NewBuffer([]byte{})
-	binary.Write(buffer, binary.BigEndian, uint32(BetResponseType))
-	binary.Write(buffer, binary.BigEndian, uint32(len(payload)))
-	buffer.Write([]byte(payload))
+func (m *BetResponse) GetMessageType() MessageType {
+	return BetResponseType
+}
 
-	return buffer.Bytes(), nil
+func (m *BetResponse) SerializePayload() ([]byte, error) {
+	var parts []string
+	switch {
+	case m.Success:
+		parts = append(parts, "SUCCESS")
+	case m.Busy:
+		parts = append(parts, "BUSY")
+	default:
+		parts = append(parts, "ERROR")
+	}
+	for _, ticket := range m.Tickets {
+		parts = append(parts, strconv.FormatInt(ticket, 10))
+	}
+	return []byte(strings.Join(parts, ";")), nil
 }
 
-func (m *BetResponse) Deserialize(data string) error {
-	if data == "SUCCESS" {
-		*m = true
-	} else {
-		*m = false
+func (m *BetResponse) Deserialize(data []byte) error {
+	parts := strings.Split(string(data), ";")
+	m.Success = parts[0] == "SUCCESS"
+	m.Busy = parts[0] == "BUSY"
+	m.Tickets = make([]int64, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		ticket, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return err
+		}
+		m.Tickets = append(m.Tickets, ticket)
 	}
 
 	return nil
 }
 
 type BatchBetMessage struct {
-	Message
 	ReceivedBets [][]string
 }
 
-func (m *BatchBetMessage) Serialize() ([]byte, error) {
+func (m *BatchBetMessage) GetMessageType() MessageType {
+	return BatchBetType
+}
+
+func (m *BatchBetMessage) SerializePayload() ([]byte, error) {
+	return batchPayload(m.ReceivedBets), nil
+}
+
+// batchPayload One line per bet with its fields separated by semicolons
+func batchPayload(received [][]string) []byte {
 	var payloadString []string
-	for _, bet := range m.ReceivedBets {
+	for _, bet := range received {
 		payloadString = append(payloadString, fmt.Sprintf("%v;%v;%v;%v;%v;%v", bet[0], bet[1], bet[2], bet[3], bet[4], bet[5]))
 	}
+	return []byte(strings.Join(payloadString, "\n"))
+}
+
+// BatchBetLineLength Bytes a bet takes in the payload of a batch, counting
+// the line separator
+func BatchBetLineLength(bet []string) int {
+	length := len(bet)
+	for _, field := range bet {
+		length += len(field)
+	}
+	return length
+}
+
+// BatchPayloadLength Bytes of the payload the bets of a batch were read
+// from
+func BatchPayloadLength(received [][]string) int {
+	length := 0
+	for _, bet := range received {
+		length += BatchBetLineLength(bet)
+	}
+	if length > 0 {
+		// The last line has no separator
+		length--
+	}
+	return length
+}
+
+func (m *BatchBetMessage) Deserialize(data []byte) error {
+	lines := strings.Split(string(data), "\n")
+
+	for _, line := range lines {
+		parts := strings.Split(line, ";")
+		m.ReceivedBets = append(m.ReceivedBets, parts)
+	}
+
+	return nil
+}
 
+// agencyPayload Payload of the messages that only carry an agency
+func agencyPayload(agency int) []byte {
 	buffer := bytes.NewBuffer([]byte{})
-	payload := []byte(strings.Join(payloadString, "\n"))
+	binary.Write(buffer, binary.BigEndian, uint32(agency))
+	return buffer.Bytes()
+}
+
+// deserializeAgency Reads the payload of the message with the given name,
+// which only carries an agency
+func deserializeAgency(name string, data []byte) (int, error) {
+	if len(data) != 4 {
+		return 0, fmt.Errorf("%v message must be 4 bytes, got %v", name, len(data))
+	}
+	return int(binary.BigEndian.Uint32(data)), nil
+}
+
+type AllBetsSentMessage struct {
+	Agency int
+}
+
+func (m *AllBetsSentMessage) GetMessageType() MessageType {
+	return AllBetsSentType
+}
+
+func (m *AllBetsSentMessage) SerializePayload() ([]byte, error) {
+	return agencyPayload(m.Agency), nil
+}
+
+func (m *AllBetsSentMessage) Deserialize(data []byte) error {
+	agency, err := deserializeAgency("all bets sent", data)
+	m.Agency = agency
+	return err
+}
+
+type ResultsQueryMessage struct {
+	Agency int
+}
+
+func (m *ResultsQueryMessage) GetMessageType() MessageType {
+	return ResultsQueryType
+}
+
+func (m *ResultsQueryMessage) SerializePayload() ([]byte, error) {
+	return agencyPayload(m.Agency), nil
+}
+
+func (m *ResultsQueryMessage) Deserialize(data []byte) error {
+	agency, err := deserializeAgency("results query", data)
+	m.Agency = agency
+	return err
+}
+
+type ResultUnavailableMessage struct {
+}
+
+func (m *ResultUnavailableMessage) GetMessageType() MessageType {
+	return ResultUnavailableType
+}
+
+func (m *ResultUnavailableMessage) SerializePayload() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (m *ResultUnavailableMessage) Deserialize(data []byte) error {
+	return nil
+}
+
+type ResultsResponseMessage struct {
+	Winners []bets.Winner
+}
+
+func (m *ResultsResponseMessage) GetMessageType() MessageType {
+	return ResultsResponseType
+}
+
+func (m *ResultsResponseMessage) SerializePayload() ([]byte, error) {
+	var parts []string
+	for _, winner := range m.Winners {
+		parts = append(parts, fmt.Sprintf("%v:%v", winner.Document, winner.Ticket))
+	}
+	return []byte(strings.Join(parts, ";")), nil
+}
+
+func (m *ResultsResponseMessage) Deserialize(data []byte) error {
+	m.Winners = []bets.Winner{}
+	if len(data) == 0 {
+		return nil
+	}
+	for _, part := range strings.Split(string(data), ";") {
+		winner := bets.Winner{Document: part}
+		if separator := strings.LastIndex(part, ":"); separator >= 0 {
+			ticket, err := strconv.ParseInt(part[separator+1:], 10, 64)
+			if err != nil {
+				return err
+			}
+			winner = bets.Winner{Document: part[:separator], Ticket: ticket}
+		}
+		m.Winners = append(m.Winners, winner)
+	}
+	return nil
+}
 
-	binary.Write(buffer, binary.BigEndian, uint32(BatchBetType))
-	binary.Write(buffer, binary.BigEndian, uint32(len(payload)))
+type DocumentQueryMessage struct {
+	Agency   int
+	Document string
+}
+
+func (m *DocumentQueryMessage) GetMessageType() MessageType {
+	return DocumentQueryType
+}
 
-	buffer.Write(payload)
+func (m *DocumentQueryMessage) SerializePayload() ([]byte, error) {
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, uint32(m.Agency))
+	buffer.Write([]byte(m.Document))
 	return buffer.Bytes(), nil
 }
 
-func (m *BatchBetMessage) Deserialize(data string) error {
-	lines := strings.Split(data, "\n")
+func (m *DocumentQueryMessage) Deserialize(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("document query too short: %v bytes", len(data))
+	}
+	m.Agency = int(binary.BigEndian.Uint32(data[:4]))
+	m.Document = string(data[4:])
+	return nil
+}
 
-	for _, line := range lines {
+// BetResult A stored bet together with the prize it won
+type BetResult struct {
+	Bet   bets.Bet
+	Prize bets.Prize
+}
+
+type DocumentResultsMessage struct {
+	Results []BetResult
+}
+
+func (m *DocumentResultsMessage) GetMessageType() MessageType {
+	return DocumentResultsType
+}
+
+func (m *DocumentResultsMessage) SerializePayload() ([]byte, error) {
+	var lines []string
+	for _, result := range m.Results {
+		bet := result.Bet
+		lines = append(lines, fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v;%v", bet.Ticket, bet.Agency, bet.FirstName, bet.LastName, bet.Document, bet.BirthDate.Format("2006-01-02"), bet.Number, result.Prize))
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+func (m *DocumentResultsMessage) Deserialize(data []byte) error {
+	m.Results = []BetResult{}
+	if len(data) == 0 {
+		return nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
 		parts := strings.Split(line, ";")
-		m.ReceivedBets = append(m.ReceivedBets, parts)
+		if len(parts) != 8 {
+			return fmt.Errorf("invalid bet result %q", line)
+		}
+		ticket, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		number, err := strconv.Atoi(parts[6])
+		if err != nil {
+			return err
+		}
+		bet, err := bets.NewBet(parts[1], parts[2], parts[3], parts[4], parts[5], number)
+		if err != nil {
+			return err
+		}
+		bet.Ticket = ticket
+		prize, err := bets.ParsePrize(parts[7])
+		if err != nil {
+			return err
+		}
+		m.Results = append(m.Results, BetResult{Bet: *bet, Prize: prize})
 	}
+	return nil
+}
 
+type CancelBetMessage struct {
+	Agency int
+	Ticket int64
+}
+
+func (m *CancelBetMessage) GetMessageType() MessageType {
+	return CancelBetType
+}
+
+func (m *CancelBetMessage) SerializePayload() ([]byte, error) {
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, uint32(m.Agency))
+	binary.Write(buffer, binary.BigEndian, uint64(m.Ticket))
+	return buffer.Bytes(), nil
+}
+
+func (m *CancelBetMessage) Deserialize(data []byte) error {
+	if len(data) != 12 {
+		return fmt.Errorf("cancel bet message must be 12 bytes, got %v", len(data))
+	}
+	m.Agency = int(binary.BigEndian.Uint32(data[:4]))
+	m.Ticket = int64(binary.BigEndian.Uint64(data[4:]))
 	return nil
 }
 
-type RawMessage struct {
-	Type    MessageType
-	Length  int
-	Payload string
+// AmendBetMessage Replaces the bet with the given ticket by Bet. The
+// agency of the new bet must be the agency of the replaced one
+type AmendBetMessage struct {
+	Ticket int64
+	Bet    bets.Bet
 }
 
-func MessageFromSocket(socket *net.Conn) (*RawMessage, error) {
-	reader := bufio.NewReader(*socket)
-	u8Buffer := make([]byte, 4)
-	_, err := io.ReadFull(reader, u8Buffer)
+func (m *AmendBetMessage) GetMessageType() MessageType {
+	return AmendBetType
+}
+
+func (m *AmendBetMessage) SerializePayload() ([]byte, error) {
+	return []byte(fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v", m.Ticket, m.Bet.Agency, m.Bet.FirstName, m.Bet.LastName, m.Bet.Document, m.Bet.BirthDate.Format("2006-01-02"), m.Bet.Number)), nil
+}
+
+func (m *AmendBetMessage) Deserialize(data []byte) error {
+	parts := strings.Split(string(data), ";")
+	if len(parts) != 7 {
+		return fmt.Errorf("amend bet message must have 7 fields, got %v", len(parts))
+	}
+	ticket, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	messageType := binary.BigEndian.Uint32(u8Buffer)
-	_, err = io.ReadFull(reader, u8Buffer)
+	number, err := strconv.Atoi(parts[6])
 	if err != nil {
-		return nil, err
+		return err
 	}
-	messageLength := binary.BigEndian.Uint32(u8Buffer)
-	payload := make([]byte, messageLength)
-	_, err = io.ReadFull(reader, payload)
+	bet, err := bets.NewBet(parts[1], parts[2], parts[3], parts[4], parts[5], number)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &RawMessage{
-		Type:    MessageType(messageType),
-		Length:  int(messageLength),
-		Payload: string(payload),
-	}, nil
+	m.Ticket = ticket
+	m.Bet = *bet
+	return nil
 }
 
-type AllBetsSentMessage struct {
-	Message
+// ServerInfoQueryMessage Asks the server for the limits it applies to the
+// messages of an agency
+type ServerInfoQueryMessage struct {
 	Agency int
 }
 
-func (m *AllBetsSentMessage) GetMessageType() MessageType {
-	return AllBetsSentType
+func (m *ServerInfoQueryMessage) GetMessageType() MessageType {
+	return ServerInfoQueryType
+}
+
+func (m *ServerInfoQueryMessage) SerializePayload() ([]byte, error) {
+	return agencyPayload(m.Agency), nil
+}
+
+func (m *ServerInfoQueryMessage) Deserialize(data []byte) error {
+	agency, err := deserializeAgency("server info query", data)
+	m.Agency = agency
+	return err
+}
+
+// ServerInfoMessage Batch sizes the server works best with and the largest
+// ones it accepts. Sizes in bytes are of the batch payload
+type ServerInfoMessage struct {
+	PreferredBatchBytes int
+	MaxBatchBytes       int
+	MaxBatchBets        int
+}
+
+func (m *ServerInfoMessage) GetMessageType() MessageType {
+	return ServerInfoType
 }
 
-func (m *AllBetsSentMessage) Serialize() ([]byte, error) {
+func (m *ServerInfoMessage) SerializePayload() ([]byte, error) {
 	buffer := bytes.NewBuffer([]byte{})
-	binary.Write(buffer, binary.BigEndian, uint32(AllBetsSentType))
-	binary.Write(buffer, binary.BigEndian, uint32(4))
-	binary.Write(buffer, binary.BigEndian, uint32(m.Agency))
+	binary.Write(buffer, binary.BigEndian, uint32(m.PreferredBatchBytes))
+	binary.Write(buffer, binary.BigEndian, uint32(m.MaxBatchBytes))
+	binary.Write(buffer, binary.BigEndian, uint32(m.MaxBatchBets))
 	return buffer.Bytes(), nil
 }
 
-func (m *AllBetsSentMessage) Deserialize(data string) error {
-	agency := binary.BigEndian.Uint32([]byte(data))
-	m.Agency = int(agency)
+func (m *ServerInfoMessage) Deserialize(data []byte) error {
+	if len(data) != 12 {
+		return fmt.Errorf("server info message must be 12 bytes, got %v", len(data))
+	}
+	m.PreferredBatchBytes = int(binary.BigEndian.Uint32(data[:4]))
+	m.MaxBatchBytes = int(binary.BigEndian.Uint32(data[4:8]))
+	m.MaxBatchBets = int(binary.BigEndian.Uint32(data[8:]))
 	return nil
 }
 
-type ResultsQueryMessage struct {
-	Message
+// StatusQueryMessage Asks the server how the upload of an agency and the
+// draw are going
+type StatusQueryMessage struct {
 	Agency int
 }
 
-func (m *ResultsQueryMessage) GetMessageType() MessageType {
-	return ResultsQueryType
+func (m *StatusQueryMessage) GetMessageType() MessageType {
+	return StatusQueryType
+}
+
+func (m *StatusQueryMessage) SerializePayload() ([]byte, error) {
+	return agencyPayload(m.Agency), nil
+}
+
+func (m *StatusQueryMessage) Deserialize(data []byte) error {
+	agency, err := deserializeAgency("status query", data)
+	m.Agency = agency
+	return err
+}
+
+// StatusMessage Bets of the agency the server stored, whether the agency
+// already sent AllBetsSent and whether the draw is closed, along with how
+// many agencies finished out of the ones the draw waits for
+type StatusMessage struct {
+	BetsCommitted    int
+	Finished         bool
+	DrawClosed       bool
+	FinishedAgencies int
+	TotalAgencies    int
+}
+
+func (m *StatusMessage) GetMessageType() MessageType {
+	return StatusType
 }
 
-func (m *ResultsQueryMessage) Serialize() ([]byte, error) {
+func (m *StatusMessage) SerializePayload() ([]byte, error) {
 	buffer := bytes.NewBuffer([]byte{})
-	binary.Write(buffer, binary.BigEndian, uint32(ResultsQueryType))
-	binary.Write(buffer, binary.BigEndian, uint32(4))
-	binary.Write(buffer, binary.BigEndian, uint32(m.Agency))
+	binary.Write(buffer, binary.BigEndian, uint32(m.BetsCommitted))
+	binary.Write(buffer, binary.BigEndian, boolFlag(m.Finished))
+	binary.Write(buffer, binary.BigEndian, boolFlag(m.DrawClosed))
+	binary.Write(buffer, binary.BigEndian, uint32(m.FinishedAgencies))
+	binary.Write(buffer, binary.BigEndian, uint32(m.TotalAgencies))
 	return buffer.Bytes(), nil
 }
 
-func (m *ResultsQueryMessage) Deserialize(data string) error {
-	agency := binary.BigEndian.Uint32([]byte(data))
-	m.Agency = int(agency)
+func (m *StatusMessage) Deserialize(data []byte) error {
+	if len(data) != 20 {
+		return fmt.Errorf("status message must be 20 bytes, got %v", len(data))
+	}
+	m.BetsCommitted = int(binary.BigEndian.Uint32(data[:4]))
+	m.Finished = binary.BigEndian.Uint32(data[4:8]) != 0
+	m.DrawClosed = binary.BigEndian.Uint32(data[8:12]) != 0
+	m.FinishedAgencies = int(binary.BigEndian.Uint32(data[12:16]))
+	m.TotalAgencies = int(binary.BigEndian.Uint32(data[16:]))
 	return nil
 }
 
-type ResultUnavailableMessage struct {
-	Message
+func boolFlag(value bool) uint32 {
+	if value {
+		return 1
+	}
+	return 0
 }
 
-func (m *ResultUnavailableMessage) GetMessageType() MessageType {
-	return ResultUnavailableType
+// NumberedBatchHeaderLength Size of the agency, session and batch ID that
+// precede the bets of a NumberedBatchMessage
+const NumberedBatchHeaderLength = 20
+
+// NumberedBatchMessage A batch of bets numbered by the agency, so several
+// can be sent on one connection before their acknowledgements arrive.
+// BatchID starts at 1 and grows by one with every batch of a Session, which
+// identifies one upload of the agency. The server acknowledges each one
+// with a BatchAckMessage carrying the same BatchID
+type NumberedBatchMessage struct {
+	Agency       int
+	Session      int64
+	BatchID      int64
+	ReceivedBets [][]string
 }
 
-func (m *ResultUnavailableMessage) Serialize() ([]byte, error) {
+func (m *NumberedBatchMessage) GetMessageType() MessageType {
+	return NumberedBatchType
+}
+
+func (m *NumberedBatchMessage) SerializePayload() ([]byte, error) {
 	buffer := bytes.NewBuffer([]byte{})
-	binary.Write(buffer, binary.BigEndian, uint32(ResultUnavailableType))
-	binary.Write(buffer, binary.BigEndian, uint32(0))
+	binary.Write(buffer, binary.BigEndian, uint32(m.Agency))
+	binary.Write(buffer, binary.BigEndian, uint64(m.Session))
+	binary.Write(buffer, binary.BigEndian, uint64(m.BatchID))
+	buffer.Write(batchPayload(m.ReceivedBets))
 	return buffer.Bytes(), nil
 }
 
-func (m *ResultUnavailableMessage) Deserialize(data string) error {
+func (m *NumberedBatchMessage) Deserialize(data []byte) error {
+	if len(data) < NumberedBatchHeaderLength {
+		return fmt.Errorf("numbered batch message must be at least %v bytes, got %v", NumberedBatchHeaderLength, len(data))
+	}
+	m.Agency = int(binary.BigEndian.Uint32(data[:4]))
+	m.Session = int64(binary.BigEndian.Uint64(data[4:12]))
+	m.BatchID = int64(binary.BigEndian.Uint64(data[12:20]))
+	var batch BatchBetMessage
+	if err := batch.Deserialize(data[NumberedBatchHeaderLength:]); err != nil {
+		return err
+	}
+	m.ReceivedBets = batch.ReceivedBets
 	return nil
 }
 
-type ResultsResponseMessage struct {
-	Message
-	Winners []string
+// BatchAckMessage Acknowledgement of the NumberedBatchMessage with the
+// given BatchID
+type BatchAckMessage struct {
+	BatchID  int64
+	Response BetResponse
 }
 
-func (m *ResultsResponseMessage) GetMessageType() MessageType {
-	return ResultsResponseType
+func (m *BatchAckMessage) GetMessageType() MessageType {
+	return BatchAckType
 }
 
-func (m *ResultsResponseMessage) Serialize() ([]byte, error) {
-	payload := strings.Join(m.Winners, ";")
+func (m *BatchAckMessage) SerializePayload() ([]byte, error) {
+	response, err := m.Response.SerializePayload()
+	if err != nil {
+		return nil, err
+	}
 	buffer := bytes.NewBuffer([]byte{})
-	binary.Write(buffer, binary.BigEndian, uint32(ResultsResponseType))
-	binary.Write(buffer, binary.BigEndian, uint32(len(payload)))
-	buffer.Write([]byte(payload))
+	binary.Write(buffer, binary.BigEndian, uint64(m.BatchID))
+	buffer.Write(response)
 	return buffer.Bytes(), nil
 }
 
-func (m *ResultsResponseMessage) Deserialize(data string) error {
-	if data == "" {
-		m.Winners = []string{}
-		return nil
+func (m *BatchAckMessage) Deserialize(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("batch ack message must be at least 8 bytes, got %v", len(data))
 	}
-	parts := strings.Split(data, ";")
-	m.Winners = parts
+	m.BatchID = int64(binary.BigEndian.Uint64(data[:8]))
+	return m.Response.Deserialize(data[8:])
+}
+
+// ChecksumErrorMessage Tells the peer that a frame it sent arrived with a
+// wrong checksum, so it sends it again. Frame is the index of the frame
+// among all the ones the peer wrote on the connection, starting at 0
+type ChecksumErrorMessage struct {
+	Frame uint64
+}
+
+func (m *ChecksumErrorMessage) GetMessageType() MessageType {
+	return ChecksumErrorType
+}
+
+func (m *ChecksumErrorMessage) SerializePayload() ([]byte, error) {
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, m.Frame)
+	return buffer.Bytes(), nil
+}
+
+func (m *ChecksumErrorMessage) Deserialize(data []byte) error {
+	if len(data) != 8 {
+		return fmt.Errorf("checksum error message must be 8 bytes, got %v", len(data))
+	}
+	m.Frame = binary.BigEndian.Uint64(data)
 	return nil
 }
+
+// PingMessage Heartbeat sent periodically to tell the peer the connection
+// is alive. The peer answers with a PongMessage with the same Sequence
+type PingMessage struct {
+	Sequence uint64
+}
+
+func (m *PingMessage) GetMessageType() MessageType {
+	return PingType
+}
+
+func (m *PingMessage) SerializePayload() ([]byte, error) {
+	return sequencePayload(m.Sequence), nil
+}
+
+func (m *PingMessage) Deserialize(data []byte) error {
+	sequence, err := deserializeSequence("ping", data)
+	m.Sequence = sequence
+	return err
+}
+
+// PongMessage Answer to a PingMessage
+type PongMessage struct {
+	Sequence uint64
+}
+
+func (m *PongMessage) GetMessageType() MessageType {
+	return PongType
+}
+
+func (m *PongMessage) SerializePayload() ([]byte, error) {
+	return sequencePayload(m.Sequence), nil
+}
+
+func (m *PongMessage) Deserialize(data []byte) error {
+	sequence, err := deserializeSequence("pong", data)
+	m.Sequence = sequence
+	return err
+}
+
+// sequencePayload Payload of the heartbeat messages
+func sequencePayload(sequence uint64) []byte {
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, sequence)
+	return buffer.Bytes()
+}
+
+// deserializeSequence Reads the payload of the heartbeat message with the
+// given name
+func deserializeSequence(name string, data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("%v message must be 8 bytes, got %v", name, len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumberedBatchesAndAcksShareOneConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	batches := []NumberedBatchMessage{
+		{Agency: 3, Session: 42, BatchID: 1, ReceivedBets: [][]string{{"3", "Juan", "Perez", "30904465", "1999-03-17", "7574"}}},
+		{Agency: 3, Session: 42, BatchID: 2, ReceivedBets: [][]string{
+			{"3", "Ana", "Gomez", "30904466", "1999-03-17", "10"},
+			{"3", "Luis", "Diaz", "30904467", "1999-03-17", "11"},
+		}},
+	}
+	go func() {
+		for i := range batches {
+			WriteMessage(client, &batches[i])
+		}
+	}()
+
+	for _, expected := range batches {
+		message, err := ReadMessage(server)
+		assert.NoError(t, err)
+		received, ok := message.(*NumberedBatchMessage)
+		assert.True(t, ok)
+		assert.Equal(t, expected.Agency, received.Agency)
+		assert.Equal(t, expected.Session, received.Session)
+		assert.Equal(t, expected.BatchID, received.BatchID)
+		assert.Equal(t, expected.ReceivedBets, received.ReceivedBets)
+	}
+
+	ack := BatchAckMessage{BatchID: 2, Response: BetResponse{Busy: true}}
+	go WriteMessage(server, &ack)
+	message, err := ReadMessage(client)
+	assert.NoError(t, err)
+	received, ok := message.(*BatchAckMessage)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), received.BatchID)
+	assert.True(t, received.Response.Busy)
+	assert.False(t, received.Response.Success)
+}
+
+func TestMessageFromSocketContextStopsWhenCanceled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := MessageFromSocketContext(ctx, server)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The connection can still be used with another context
+	query := StatusQueryMessage{Agency: 2}
+	go WriteMessageContext(context.Background(), client, &query)
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), time.Second)
+	defer cancelTimeout()
+	message, err := MessageFromSocketContext(timeout, server)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusQueryType, message.Type)
+}
+
+func TestReadMessageReportsUnknownAndMalformedMessages(t *testing.T) {
+	var buffer bytes.Buffer
+	WriteSafe(&buffer, []byte{0, 0, 0, 99, 0, 0, 0, 1, 'x'})
+	WriteSafe(&buffer, []byte{0, 0, 0, byte(BetType), 0, 0, 0, 3, '1', ';', '2'})
+	WriteMessage(&buffer, &StatusQueryMessage{Agency: 4})
+
+	_, err := ReadMessage(&buffer)
+	assert.ErrorIs(t, err, ErrUnknownMessageType)
+
+	_, err = ReadMessage(&buffer)
+	var malformed *MalformedMessageError
+	assert.ErrorAs(t, err, &malformed)
+	assert.Equal(t, BetType, malformed.Type)
+
+	// Both were read whole, so the next message is still in sync
+	message, err := ReadMessage(&buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, &StatusQueryMessage{Agency: 4}, message)
+}
+
+func TestBatchPayloadLengthMatchesSerializedPayload(t *testing.T) {
+	batch := BatchBetMessage{ReceivedBets: [][]string{
+		{"3", "Ana", "Gomez", "30904466", "1999-03-17", "10"},
+		{"3", "Luis", "Diaz", "30904467", "1999-03-17", "11"},
+	}}
+	payload, err := batch.SerializePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, len(payload), BatchPayloadLength(batch.ReceivedBets))
+}
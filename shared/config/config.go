@@ -0,0 +1,691 @@
+// Package config loads the server and client configuration.
+//
+// Every value can come from four sources. Each source overrides the ones
+// listed before it:
+//
+//  1. Built-in defaults
+//  2. The config file (./config.ini for the server, ./config.yaml for the client)
+//  3. Environment variables (SERVER_PORT, AGENCIES_AMOUNT, CLI_ID, CLI_SERVER_ADDRESS, ...)
+//  4. Command line flags (--port, --agencies-amount, --id, --server-address, ...)
+//
+// The server can also reload its configuration while running, see
+// WatchConfigFile.
+//
+// Both binaries also accept --print-config, which prints the resolved
+// configuration and exits, and --check-config, which only validates it.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Mode tells the binary what to do once the configuration is loaded
+type Mode int
+
+const (
+	// RunMode runs the program normally
+	RunMode Mode = iota
+	// PrintMode prints the resolved configuration and exits
+	PrintMode
+	// CheckMode validates the configuration and exits
+	CheckMode
+)
+
+const (
+	MinPort        = 1
+	MaxPort        = 65535
+	MaxBatchAmount = 10000
+)
+
+var validLogLevels = []string{"CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+// InputFormats Formats of the agency bets file the client can read
+var InputFormats = []string{"csv", "csv-header", "tsv", "jsonl", "fixed"}
+
+// WinnersFormats Formats the client can write the winners file in
+var WinnersFormats = []string{"csv", "json"}
+
+// ClientCommands Subcommands of the client. all uploads the bets, finishes
+// the agency and waits for the winners, the others do one step each
+var ClientCommands = []string{"all", "upload", "finish", "results", "status"}
+
+// ValidationError Lists every problem found while validating a configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// Server Configuration used by the server binary
+type Server struct {
+	ConfigFile     string
+	Port           int
+	Ip             string
+	LoggingLevel   string
+	AgenciesAmount int
+	MaxConnections int
+	DrawDeadline   time.Duration
+	// BatchPreferredBytes and BatchMaxBytes Batch payload sizes the server
+	// advertises to the agencies
+	BatchPreferredBytes int
+	BatchMaxBytes       int
+	// MaxPendingBatches Batches the server processes at once before it
+	// answers busy, 0 for no limit
+	MaxPendingBatches int
+	// ShutdownGrace Time the connections get to finish the message they are
+	// processing when the server shuts down
+	ShutdownGrace time.Duration
+	// HeartbeatInterval Time between the Pings sent to the agencies that
+	// send them, 0 for none
+	HeartbeatInterval time.Duration
+	// HeartbeatMisses Intervals without hearing from an agency after which
+	// its connection is closed
+	HeartbeatMisses int
+}
+
+// Validate Checks required fields and value ranges
+func (c *Server) Validate() error {
+	var problems ValidationError
+	problems = checkPort(problems, "server_port", c.Port)
+	problems = checkLogLevel(problems, "logging_level", c.LoggingLevel)
+	if c.AgenciesAmount < 1 {
+		problems = append(problems, fmt.Sprintf("agencies_amount must be at least 1, got %v", c.AgenciesAmount))
+	}
+	if c.MaxConnections < 0 {
+		problems = append(problems, fmt.Sprintf("max_connections must not be negative, got %v", c.MaxConnections))
+	}
+	if c.DrawDeadline < 0 {
+		problems = append(problems, fmt.Sprintf("draw_deadline must not be negative, got %v", c.DrawDeadline))
+	}
+	if c.BatchPreferredBytes < 1 {
+		problems = append(problems, fmt.Sprintf("batch_preferred_bytes must be at least 1, got %v", c.BatchPreferredBytes))
+	}
+	if c.BatchMaxBytes < c.BatchPreferredBytes {
+		problems = append(problems, fmt.Sprintf("batch_max_bytes must be at least batch_preferred_bytes (%v), got %v", c.BatchPreferredBytes, c.BatchMaxBytes))
+	}
+	if c.MaxPendingBatches < 0 {
+		problems = append(problems, fmt.Sprintf("max_pending_batches must not be negative, got %v", c.MaxPendingBatches))
+	}
+	if c.ShutdownGrace < 0 {
+		problems = append(problems, fmt.Sprintf("shutdown_grace must not be negative, got %v", c.ShutdownGrace))
+	}
+	if c.HeartbeatInterval < 0 {
+		problems = append(problems, fmt.Sprintf("heartbeat_interval must not be negative, got %v", c.HeartbeatInterval))
+	}
+	if c.HeartbeatMisses < 1 {
+		problems = append(problems, fmt.Sprintf("heartbeat_misses must be at least 1, got %v", c.HeartbeatMisses))
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Print Writes the resolved configuration, one key per line
+func (c *Server) Print(w io.Writer) {
+	fmt.Fprintf(w, "server_port: %v\n", c.Port)
+	fmt.Fprintf(w, "server_ip: %v\n", c.Ip)
+	fmt.Fprintf(w, "logging_level: %v\n", c.LoggingLevel)
+	fmt.Fprintf(w, "agencies_amount: %v\n", c.AgenciesAmount)
+	fmt.Fprintf(w, "max_connections: %v\n", c.MaxConnections)
+	fmt.Fprintf(w, "draw_deadline: %v\n", c.DrawDeadline)
+	fmt.Fprintf(w, "batch_preferred_bytes: %v\n", c.BatchPreferredBytes)
+	fmt.Fprintf(w, "batch_max_bytes: %v\n", c.BatchMaxBytes)
+	fmt.Fprintf(w, "max_pending_batches: %v\n", c.MaxPendingBatches)
+	fmt.Fprintf(w, "shutdown_grace: %v\n", c.ShutdownGrace)
+	fmt.Fprintf(w, "heartbeat_interval: %v\n", c.HeartbeatInterval)
+	fmt.Fprintf(w, "heartbeat_misses: %v\n", c.HeartbeatMisses)
+}
+
+// Agency An agency the client uploads bets for and the file with its bets
+type Agency struct {
+	ID        int
+	InputPath string
+}
+
+func (a Agency) String() string {
+	return fmt.Sprintf("%v=%v", a.ID, a.InputPath)
+}
+
+// parseAgencies Reads agencies given as id=path, several may come in one
+// entry separated by commas. Entries that can't be read are kept with ID 0
+// so validation reports them
+func parseAgencies(entries []string) []Agency {
+	var agencies []Agency
+	for _, entry := range entries {
+		for _, item := range strings.Split(entry, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			var agency Agency
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) == 2 {
+				agency.ID, _ = strconv.Atoi(strings.TrimSpace(parts[0]))
+				agency.InputPath = strings.TrimSpace(parts[1])
+			}
+			agencies = append(agencies, agency)
+		}
+	}
+	return agencies
+}
+
+// Client Configuration used by the client binary
+type Client struct {
+	// Command Subcommand the client runs, one of ClientCommands
+	Command        string
+	ID             int
+	ServerAddress  string
+	LoopAmount     int
+	LoopPeriod     time.Duration
+	LogLevel       string
+	BatchMaxAmount int
+	BatchMaxBytes  int
+	BatchWindow    int
+	InputPath      string
+	InputFormat    string
+	RejectsPath    string
+	DryRun         bool
+	// Agencies Agencies uploaded at once by the client. When empty the
+	// client uploads the file at InputPath for agency ID
+	Agencies       []Agency
+	MaxConnections int
+	// Checksum Whether the frames the client sends carry a CRC32C trailer
+	Checksum bool
+	// Compression Whether the batches the client sends are compressed
+	Compression bool
+	// CompressionThreshold Smallest batch payload that is compressed
+	CompressionThreshold int
+	// HeartbeatInterval Time between the Pings sent on every connection, 0
+	// for none
+	HeartbeatInterval time.Duration
+	// HeartbeatMisses Intervals without hearing from the server while
+	// waiting for it after which the connection is given up
+	HeartbeatMisses int
+	// ProgressInterval Time between upload progress lines, 0 for none
+	ProgressInterval time.Duration
+	// SummaryPath JSON file where the upload summary is written, empty for
+	// none
+	SummaryPath string
+	// ResultsTimeout Time the client waits for the draw to close to get the
+	// winners
+	ResultsTimeout time.Duration
+	// WinnersPath File where the winners of the agency are written, empty
+	// for none
+	WinnersPath   string
+	WinnersFormat string
+	FirstName     string
+	LastName      string
+	Document      string
+	BirthDate     time.Time
+	Number        int
+}
+
+// Validate Checks required fields and value ranges
+func (c *Client) Validate() error {
+	var problems ValidationError
+	if !contains(ClientCommands, c.Command) {
+		problems = append(problems, fmt.Sprintf("command must be one of %v, got %q", strings.Join(ClientCommands, ", "), c.Command))
+	}
+	if len(c.Agencies) == 0 && c.ID < 1 {
+		problems = append(problems, fmt.Sprintf("id must be a positive agency number, got %v", c.ID))
+	}
+	seen := make(map[int]bool)
+	for _, agency := range c.Agencies {
+		if agency.ID < 1 || agency.InputPath == "" {
+			problems = append(problems, fmt.Sprintf("agencies must be given as id=path with a positive id, got %q", agency.String()))
+			continue
+		}
+		if seen[agency.ID] {
+			problems = append(problems, fmt.Sprintf("agencies lists agency %v more than once", agency.ID))
+		}
+		seen[agency.ID] = true
+	}
+	if c.ProgressInterval < 0 {
+		problems = append(problems, fmt.Sprintf("progress.interval must not be negative, got %v", c.ProgressInterval))
+	}
+	if c.ResultsTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("results.timeout must not be negative, got %v", c.ResultsTimeout))
+	}
+	if c.MaxConnections < 1 {
+		problems = append(problems, fmt.Sprintf("connections.max must be at least 1, got %v", c.MaxConnections))
+	}
+	if c.CompressionThreshold < 0 {
+		problems = append(problems, fmt.Sprintf("connections.compressionThreshold must not be negative, got %v", c.CompressionThreshold))
+	}
+	if c.HeartbeatInterval < 0 {
+		problems = append(problems, fmt.Sprintf("connections.heartbeatInterval must not be negative, got %v", c.HeartbeatInterval))
+	}
+	if c.HeartbeatMisses < 1 {
+		problems = append(problems, fmt.Sprintf("connections.heartbeatMisses must be at least 1, got %v", c.HeartbeatMisses))
+	}
+	if c.ServerAddress == "" {
+		problems = append(problems, "server.address is required")
+	}
+	if c.LoopPeriod < 0 {
+		problems = append(problems, fmt.Sprintf("loop.period must not be negative, got %v", c.LoopPeriod))
+	}
+	problems = checkLogLevel(problems, "log.level", c.LogLevel)
+	if c.BatchMaxAmount < 1 || c.BatchMaxAmount > MaxBatchAmount {
+		problems = append(problems, fmt.Sprintf("batch.maxAmount must be between 1 and %v, got %v", MaxBatchAmount, c.BatchMaxAmount))
+	}
+	if c.BatchMaxBytes < 1 {
+		problems = append(problems, fmt.Sprintf("batch.maxBytes must be at least 1, got %v", c.BatchMaxBytes))
+	}
+	if c.BatchWindow < 1 {
+		problems = append(problems, fmt.Sprintf("batch.window must be at least 1, got %v", c.BatchWindow))
+	}
+	if c.InputPath == "" {
+		problems = append(problems, "input.path is required")
+	}
+	if !contains(InputFormats, c.InputFormat) {
+		problems = append(problems, fmt.Sprintf("input.format must be one of %v, got %q", strings.Join(InputFormats, ", "), c.InputFormat))
+	}
+	if !contains(WinnersFormats, c.WinnersFormat) {
+		problems = append(problems, fmt.Sprintf("results.format must be one of %v, got %q", strings.Join(WinnersFormats, ", "), c.WinnersFormat))
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Print Writes the resolved configuration, one key per line
+func (c *Client) Print(w io.Writer) {
+	fmt.Fprintf(w, "command: %v\n", c.Command)
+	fmt.Fprintf(w, "id: %v\n", c.ID)
+	fmt.Fprintf(w, "server.address: %v\n", c.ServerAddress)
+	fmt.Fprintf(w, "loop.amount: %v\n", c.LoopAmount)
+	fmt.Fprintf(w, "loop.period: %v\n", c.LoopPeriod)
+	fmt.Fprintf(w, "log.level: %v\n", c.LogLevel)
+	fmt.Fprintf(w, "batch.maxAmount: %v\n", c.BatchMaxAmount)
+	fmt.Fprintf(w, "batch.maxBytes: %v\n", c.BatchMaxBytes)
+	fmt.Fprintf(w, "batch.window: %v\n", c.BatchWindow)
+	fmt.Fprintf(w, "input.path: %v\n", c.InputPath)
+	fmt.Fprintf(w, "input.format: %v\n", c.InputFormat)
+	fmt.Fprintf(w, "input.rejects: %v\n", c.RejectsPath)
+	fmt.Fprintf(w, "dry_run: %v\n", c.DryRun)
+	fmt.Fprintf(w, "agencies: %v\n", agencyList(c.Agencies))
+	fmt.Fprintf(w, "connections.max: %v\n", c.MaxConnections)
+	fmt.Fprintf(w, "connections.checksum: %v\n", c.Checksum)
+	fmt.Fprintf(w, "connections.compression: %v\n", c.Compression)
+	fmt.Fprintf(w, "connections.compressionThreshold: %v\n", c.CompressionThreshold)
+	fmt.Fprintf(w, "connections.heartbeatInterval: %v\n", c.HeartbeatInterval)
+	fmt.Fprintf(w, "connections.heartbeatMisses: %v\n", c.HeartbeatMisses)
+	fmt.Fprintf(w, "progress.interval: %v\n", c.ProgressInterval)
+	fmt.Fprintf(w, "progress.summary: %v\n", c.SummaryPath)
+	fmt.Fprintf(w, "results.timeout: %v\n", c.ResultsTimeout)
+	fmt.Fprintf(w, "results.path: %v\n", c.WinnersPath)
+	fmt.Fprintf(w, "results.format: %v\n", c.WinnersFormat)
+	fmt.Fprintf(w, "nombre: %v\n", c.FirstName)
+	fmt.Fprintf(w, "apellido: %v\n", c.LastName)
+	fmt.Fprintf(w, "documento: %v\n", c.Document)
+	fmt.Fprintf(w, "nacimiento: %v\n", c.BirthDate.Format("2006-01-02"))
+	fmt.Fprintf(w, "numero: %v\n", c.Number)
+}
+
+func agencyList(agencies []Agency) string {
+	items := make([]string, 0, len(agencies))
+	for _, agency := range agencies {
+		items = append(items, agency.String())
+	}
+	return strings.Join(items, ",")
+}
+
+// LoadServer Resolves the server configuration from args and the other
+// sources. The returned config is nil only when it could not be resolved
+// at all; if it is just invalid both the config and the validation error
+// are returned so it can still be printed
+func LoadServer(args []string) (*Server, Mode, error) {
+	fs := pflag.NewFlagSet("server", pflag.ContinueOnError)
+	configFile := fs.String("config", "./config.ini", "path to the config file")
+	fs.Int("port", 0, "port to listen on (env SERVER_PORT)")
+	fs.String("ip", "", "address to listen on (env SERVER_IP)")
+	fs.String("logging-level", "", "logging level (env LOGGING_LEVEL)")
+	fs.Int("agencies-amount", 0, "number of agencies taking part in the draw (env AGENCIES_AMOUNT)")
+	fs.Int("max-connections", 0, "maximum simultaneous client connections, 0 for no limit (env MAX_CONNECTIONS)")
+	fs.Int("batch-preferred-bytes", 0, "batch payload size advertised as preferred to the agencies (env BATCH_PREFERRED_BYTES)")
+	fs.Int("batch-max-bytes", 0, "largest batch payload accepted (env BATCH_MAX_BYTES)")
+	fs.Int("max-pending-batches", 0, "batches processed at once before answering busy, 0 for no limit (env MAX_PENDING_BATCHES)")
+	fs.Duration("draw-deadline", 0, "time since the server started after which the draw closes even if agencies are missing, 0 for no deadline (env DRAW_DEADLINE)")
+	fs.Duration("shutdown-grace", 0, "time the connections get to finish the message they are processing on SIGTERM (env SHUTDOWN_GRACE)")
+	fs.Duration("heartbeat-interval", 0, "time between the pings sent to every agency, 0 for none (env HEARTBEAT_INTERVAL)")
+	fs.Int("heartbeat-misses", 0, "heartbeat intervals without hearing from an agency before closing its connection (env HEARTBEAT_MISSES)")
+	mode := addModeFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, RunMode, err
+	}
+
+	v := viper.New()
+	v.SetDefault("default.server_port", 12345)
+	v.SetDefault("default.server_ip", "")
+	v.SetDefault("default.logging_level", "INFO")
+	v.SetDefault("default.max_connections", 0)
+	v.SetDefault("default.draw_deadline", "0s")
+	v.SetDefault("default.batch_preferred_bytes", 8*1024)
+	v.SetDefault("default.batch_max_bytes", 64*1024)
+	v.SetDefault("default.max_pending_batches", 8)
+	v.SetDefault("default.shutdown_grace", "10s")
+	v.SetDefault("default.heartbeat_interval", "5s")
+	v.SetDefault("default.heartbeat_misses", 3)
+
+	v.BindEnv("default.server_port", "SERVER_PORT")
+	v.BindEnv("default.server_ip", "SERVER_IP")
+	v.BindEnv("default.logging_level", "LOGGING_LEVEL")
+	v.BindEnv("agencies_amount", "AGENCIES_AMOUNT")
+	v.BindEnv("default.max_connections", "MAX_CONNECTIONS")
+	v.BindEnv("default.draw_deadline", "DRAW_DEADLINE")
+	v.BindEnv("default.batch_preferred_bytes", "BATCH_PREFERRED_BYTES")
+	v.BindEnv("default.batch_max_bytes", "BATCH_MAX_BYTES")
+	v.BindEnv("default.max_pending_batches", "MAX_PENDING_BATCHES")
+	v.BindEnv("default.shutdown_grace", "SHUTDOWN_GRACE")
+	v.BindEnv("default.heartbeat_interval", "HEARTBEAT_INTERVAL")
+	v.BindEnv("default.heartbeat_misses", "HEARTBEAT_MISSES")
+
+	v.BindPFlag("default.server_port", fs.Lookup("port"))
+	v.BindPFlag("default.server_ip", fs.Lookup("ip"))
+	v.BindPFlag("default.logging_level", fs.Lookup("logging-level"))
+	v.BindPFlag("agencies_amount", fs.Lookup("agencies-amount"))
+	v.BindPFlag("default.max_connections", fs.Lookup("max-connections"))
+	v.BindPFlag("default.draw_deadline", fs.Lookup("draw-deadline"))
+	v.BindPFlag("default.batch_preferred_bytes", fs.Lookup("batch-preferred-bytes"))
+	v.BindPFlag("default.batch_max_bytes", fs.Lookup("batch-max-bytes"))
+	v.BindPFlag("default.max_pending_batches", fs.Lookup("max-pending-batches"))
+	v.BindPFlag("default.shutdown_grace", fs.Lookup("shutdown-grace"))
+	v.BindPFlag("default.heartbeat_interval", fs.Lookup("heartbeat-interval"))
+	v.BindPFlag("default.heartbeat_misses", fs.Lookup("heartbeat-misses"))
+
+	if err := readConfigFile(v, *configFile, fs.Changed("config")); err != nil {
+		return nil, RunMode, err
+	}
+
+	config := &Server{
+		ConfigFile:     *configFile,
+		Port:           v.GetInt("default.server_port"),
+		Ip:             v.GetString("default.server_ip"),
+		LoggingLevel:   strings.ToUpper(v.GetString("default.logging_level")),
+		AgenciesAmount: v.GetInt("agencies_amount"),
+		MaxConnections: v.GetInt("default.max_connections"),
+		DrawDeadline:   v.GetDuration("default.draw_deadline"),
+
+		BatchPreferredBytes: v.GetInt("default.batch_preferred_bytes"),
+		BatchMaxBytes:       v.GetInt("default.batch_max_bytes"),
+		MaxPendingBatches:   v.GetInt("default.max_pending_batches"),
+		ShutdownGrace:       v.GetDuration("default.shutdown_grace"),
+		HeartbeatInterval:   v.GetDuration("default.heartbeat_interval"),
+		HeartbeatMisses:     v.GetInt("default.heartbeat_misses"),
+	}
+
+	return config, mode(), config.Validate()
+}
+
+// LoadClient Resolves the client configuration from args and the other
+// sources. See LoadServer for the meaning of the returned values. The only
+// argument that is not a flag, if any, is the command to run
+func LoadClient(args []string) (*Client, Mode, error) {
+	fs := pflag.NewFlagSet("client", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: client [%v] [flags]\n", strings.Join(ClientCommands, "|"))
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", "./config.yaml", "path to the config file")
+	fs.Int("id", 0, "agency number (env CLI_ID)")
+	fs.String("server-address", "", "server host:port (env CLI_SERVER_ADDRESS)")
+	fs.Int("loop-amount", 0, "amount of messages to send (env CLI_LOOP_AMOUNT)")
+	fs.String("loop-period", "", "time between messages (env CLI_LOOP_PERIOD)")
+	fs.String("log-level", "", "logging level (env CLI_LOG_LEVEL)")
+	fs.Int("batch-max-amount", 0, "maximum bets per batch (env CLI_BATCH_MAXAMOUNT)")
+	fs.Int("batch-max-bytes", 0, "maximum batch payload size in bytes (env CLI_BATCH_MAXBYTES)")
+	fs.Int("batch-window", 0, "batches sent before waiting for their acknowledgement (env CLI_BATCH_WINDOW)")
+	fs.String("input-path", "", "agency bets file (env CLI_INPUT_PATH)")
+	fs.String("input-format", "", "format of the agency bets file: "+strings.Join(InputFormats, ", ")+" (env CLI_INPUT_FORMAT)")
+	fs.String("rejects-path", "", "file where the lines that are not sent are written, empty for none (env CLI_INPUT_REJECTS)")
+	fs.Bool("dry-run", false, "validate the agency bets file and print a summary without connecting to the server (env CLI_DRY_RUN)")
+	fs.StringSlice("agencies", nil, "agencies to upload at once as id=path, separated by commas (env CLI_AGENCIES)")
+	fs.Int("max-connections", 0, "connections open at once shared by every agency (env CLI_CONNECTIONS_MAX)")
+	fs.Bool("checksum", false, "add a CRC32C checksum to every frame and send again the corrupted ones (env CLI_CONNECTIONS_CHECKSUM)")
+	fs.Bool("compression", false, "compress the batches whose payload reaches the compression threshold (env CLI_CONNECTIONS_COMPRESSION)")
+	fs.Int("compression-threshold", 0, "smallest batch payload in bytes that is compressed (env CLI_CONNECTIONS_COMPRESSIONTHRESHOLD)")
+	fs.String("heartbeat-interval", "", "time between the pings sent on every connection, 0 for none (env CLI_CONNECTIONS_HEARTBEATINTERVAL)")
+	fs.Int("heartbeat-misses", 0, "heartbeat intervals without hearing from the server before reconnecting (env CLI_CONNECTIONS_HEARTBEATMISSES)")
+	fs.String("progress-interval", "", "time between upload progress lines, 0 for none (env CLI_PROGRESS_INTERVAL)")
+	fs.String("summary-path", "", "JSON file where the upload summary is written, empty for none (env CLI_PROGRESS_SUMMARY)")
+	fs.String("results-timeout", "", "time to wait for the draw to close to get the winners (env CLI_RESULTS_TIMEOUT)")
+	fs.String("results-path", "", "file where the winners of the agency are written, empty for none (env CLI_RESULTS_PATH)")
+	fs.String("results-format", "", "format of the winners file: "+strings.Join(WinnersFormats, ", ")+" (env CLI_RESULTS_FORMAT)")
+	mode := addModeFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, RunMode, err
+	}
+	if fs.NArg() > 1 {
+		return nil, RunMode, fmt.Errorf("expected a single command, got %q", strings.Join(fs.Args(), " "))
+	}
+
+	v := viper.New()
+	v.SetDefault("command", "all")
+	v.SetDefault("loop.amount", 0)
+	v.SetDefault("loop.period", "0s")
+	v.SetDefault("log.level", "INFO")
+	v.SetDefault("batch.maxAmount", 105)
+	v.SetDefault("batch.maxBytes", 8*1024)
+	v.SetDefault("batch.window", 4)
+	v.SetDefault("connections.max", 4)
+	v.SetDefault("connections.checksum", true)
+	v.SetDefault("connections.compression", true)
+	v.SetDefault("connections.compressionThreshold", 1024)
+	v.SetDefault("connections.heartbeatInterval", "5s")
+	v.SetDefault("connections.heartbeatMisses", 3)
+	v.SetDefault("progress.interval", "5s")
+	v.SetDefault("results.timeout", "30s")
+	v.SetDefault("results.path", "./winners.csv")
+	v.SetDefault("results.format", "csv")
+	v.SetDefault("input.path", "/agency.csv")
+	v.SetDefault("input.format", "csv")
+	v.SetDefault("input.rejects", "./rejects.csv")
+	v.SetDefault("dry_run", false)
+
+	// Configure viper to read env variables with the CLI_ prefix
+	v.AutomaticEnv()
+	v.SetEnvPrefix("cli")
+	// Use a replacer to replace env variables underscores with points. This let us
+	// use nested configurations in the config file and at the same time define
+	// env variables for the nested configurations
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	v.BindEnv("command")
+	v.BindEnv("id")
+	v.BindEnv("server.address")
+	v.BindEnv("loop.period")
+	v.BindEnv("loop.amount")
+	v.BindEnv("log.level")
+	v.BindEnv("nombre")
+	v.BindEnv("apellido")
+	v.BindEnv("documento")
+	v.BindEnv("nacimiento")
+	v.BindEnv("numero")
+	v.BindEnv("batch.maxAmount")
+	v.BindEnv("batch.maxBytes")
+	v.BindEnv("batch.window")
+	v.BindEnv("input.path")
+	v.BindEnv("input.format")
+	v.BindEnv("input.rejects")
+	v.BindEnv("dry_run")
+	v.BindEnv("agencies")
+	v.BindEnv("connections.max")
+	v.BindEnv("connections.checksum")
+	v.BindEnv("connections.compression")
+	v.BindEnv("connections.compressionThreshold")
+	v.BindEnv("connections.heartbeatInterval")
+	v.BindEnv("connections.heartbeatMisses")
+	v.BindEnv("progress.interval")
+	v.BindEnv("progress.summary")
+	v.BindEnv("results.timeout")
+	v.BindEnv("results.path")
+	v.BindEnv("results.format")
+
+	v.BindPFlag("id", fs.Lookup("id"))
+	v.BindPFlag("server.address", fs.Lookup("server-address"))
+	v.BindPFlag("loop.amount", fs.Lookup("loop-amount"))
+	v.BindPFlag("loop.period", fs.Lookup("loop-period"))
+	v.BindPFlag("log.level", fs.Lookup("log-level"))
+	v.BindPFlag("batch.maxAmount", fs.Lookup("batch-max-amount"))
+	v.BindPFlag("batch.maxBytes", fs.Lookup("batch-max-bytes"))
+	v.BindPFlag("batch.window", fs.Lookup("batch-window"))
+	v.BindPFlag("input.path", fs.Lookup("input-path"))
+	v.BindPFlag("input.format", fs.Lookup("input-format"))
+	v.BindPFlag("input.rejects", fs.Lookup("rejects-path"))
+	v.BindPFlag("dry_run", fs.Lookup("dry-run"))
+	v.BindPFlag("agencies", fs.Lookup("agencies"))
+	v.BindPFlag("connections.max", fs.Lookup("max-connections"))
+	v.BindPFlag("connections.checksum", fs.Lookup("checksum"))
+	v.BindPFlag("connections.compression", fs.Lookup("compression"))
+	v.BindPFlag("connections.compressionThreshold", fs.Lookup("compression-threshold"))
+	v.BindPFlag("connections.heartbeatInterval", fs.Lookup("heartbeat-interval"))
+	v.BindPFlag("connections.heartbeatMisses", fs.Lookup("heartbeat-misses"))
+	v.BindPFlag("progress.interval", fs.Lookup("progress-interval"))
+	v.BindPFlag("progress.summary", fs.Lookup("summary-path"))
+	v.BindPFlag("results.timeout", fs.Lookup("results-timeout"))
+	v.BindPFlag("results.path", fs.Lookup("results-path"))
+	v.BindPFlag("results.format", fs.Lookup("results-format"))
+
+	if err := readConfigFile(v, *configFile, fs.Changed("config")); err != nil {
+		return nil, RunMode, err
+	}
+	// The command given as an argument comes before the other sources
+	if fs.NArg() == 1 {
+		v.Set("command", fs.Arg(0))
+	}
+
+	// Parse time.Duration variables and return an error if those variables cannot be parsed
+	loopPeriod, err := time.ParseDuration(v.GetString("loop.period"))
+	if err != nil {
+		return nil, RunMode, fmt.Errorf("could not parse loop.period as time.Duration: %v", err)
+	}
+	progressInterval, err := time.ParseDuration(v.GetString("progress.interval"))
+	if err != nil {
+		return nil, RunMode, fmt.Errorf("could not parse progress.interval as time.Duration: %v", err)
+	}
+	resultsTimeout, err := time.ParseDuration(v.GetString("results.timeout"))
+	if err != nil {
+		return nil, RunMode, fmt.Errorf("could not parse results.timeout as time.Duration: %v", err)
+	}
+	heartbeatInterval, err := time.ParseDuration(v.GetString("connections.heartbeatInterval"))
+	if err != nil {
+		return nil, RunMode, fmt.Errorf("could not parse connections.heartbeatInterval as time.Duration: %v", err)
+	}
+
+	config := &Client{
+		Command:              strings.ToLower(v.GetString("command")),
+		ID:                   v.GetInt("id"),
+		ServerAddress:        v.GetString("server.address"),
+		LoopAmount:           v.GetInt("loop.amount"),
+		LoopPeriod:           loopPeriod,
+		LogLevel:             strings.ToUpper(v.GetString("log.level")),
+		BatchMaxAmount:       v.GetInt("batch.maxAmount"),
+		BatchMaxBytes:        v.GetInt("batch.maxBytes"),
+		BatchWindow:          v.GetInt("batch.window"),
+		InputPath:            v.GetString("input.path"),
+		InputFormat:          strings.ToLower(v.GetString("input.format")),
+		RejectsPath:          v.GetString("input.rejects"),
+		DryRun:               v.GetBool("dry_run"),
+		Agencies:             parseAgencies(v.GetStringSlice("agencies")),
+		MaxConnections:       v.GetInt("connections.max"),
+		Checksum:             v.GetBool("connections.checksum"),
+		Compression:          v.GetBool("connections.compression"),
+		CompressionThreshold: v.GetInt("connections.compressionThreshold"),
+		HeartbeatInterval:    heartbeatInterval,
+		HeartbeatMisses:      v.GetInt("connections.heartbeatMisses"),
+		ProgressInterval:     progressInterval,
+		SummaryPath:          v.GetString("progress.summary"),
+		ResultsTimeout:       resultsTimeout,
+		WinnersPath:          v.GetString("results.path"),
+		WinnersFormat:        strings.ToLower(v.GetString("results.format")),
+		FirstName:            v.GetString("nombre"),
+		LastName:             v.GetString("apellido"),
+		Document:             v.GetString("documento"),
+		BirthDate:            v.GetTime("nacimiento"),
+		Number:               v.GetInt("numero"),
+	}
+
+	return config, mode(), config.Validate()
+}
+
+// WatchConfigFile Calls onChange every time the config file at path is
+// created or written. The file is watched in the background for the rest
+// of the program's life
+func WatchConfigFile(path string, onChange func()) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.OnConfigChange(func(fsnotify.Event) {
+		onChange()
+	})
+	v.WatchConfig()
+}
+
+func addModeFlags(fs *pflag.FlagSet) func() Mode {
+	printConfig := fs.Bool("print-config", false, "print the resolved configuration and exit")
+	checkConfig := fs.Bool("check-config", false, "validate the configuration and exit")
+	return func() Mode {
+		switch {
+		case *printConfig:
+			return PrintMode
+		case *checkConfig:
+			return CheckMode
+		default:
+			return RunMode
+		}
+	}
+}
+
+// readConfigFile Try to read configuration from config file. If the default
+// config file does not exist the configuration can still be loaded from the
+// environment variables and flags, so that is not an error. A config file
+// explicitly asked for with --config must exist
+func readConfigFile(v *viper.Viper, path string, explicit bool) error {
+	v.SetConfigFile(path)
+	err := v.ReadInConfig()
+	if err == nil {
+		return nil
+	}
+	var pathErr *os.PathError
+	if !explicit && errors.As(err, &pathErr) {
+		fmt.Fprintf(os.Stderr, "Configuration could not be read from config file. Using env variables instead\n")
+		return nil
+	}
+	return fmt.Errorf("error reading config file %v: %v", path, err)
+}
+
+func checkPort(problems ValidationError, key string, port int) ValidationError {
+	if port < MinPort || port > MaxPort {
+		return append(problems, fmt.Sprintf("%v must be between %v and %v, got %v", key, MinPort, MaxPort, port))
+	}
+	return problems
+}
+
+func checkLogLevel(problems ValidationError, key string, level string) ValidationError {
+	if contains(validLogLevels, level) {
+		return problems
+	}
+	return append(problems, fmt.Sprintf("%v must be one of %v, got %q", key, strings.Join(validLogLevels, ", "), level))
+}
+
+func contains(values []string, value string) bool {
+	for _, valid := range values {
+		if value == valid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.NoError(t, err)
+	return path
+}
+
+func TestLoadServerUsesDefaultsAndConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "config.ini", "[DEFAULT]\nSERVER_IP = server\nLOGGING_LEVEL = debug\n")
+	t.Setenv("AGENCIES_AMOUNT", "5")
+
+	cfg, mode, err := LoadServer([]string{"--config", path})
+	assert.NoError(t, err)
+	assert.Equal(t, RunMode, mode)
+	assert.Equal(t, 12345, cfg.Port)
+	assert.Equal(t, "server", cfg.Ip)
+	assert.Equal(t, "DEBUG", cfg.LoggingLevel)
+	assert.Equal(t, 5, cfg.AgenciesAmount)
+}
+
+func TestLoadServerFlagsOverrideEnvOverrideFile(t *testing.T) {
+	path := writeConfigFile(t, "config.ini", "[DEFAULT]\nSERVER_PORT = 1000\nLOGGING_LEVEL = INFO\n")
+	t.Setenv("SERVER_PORT", "2000")
+	t.Setenv("LOGGING_LEVEL", "ERROR")
+	t.Setenv("AGENCIES_AMOUNT", "5")
+
+	cfg, _, err := LoadServer([]string{"--config", path, "--port", "3000"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3000, cfg.Port)
+	assert.Equal(t, "ERROR", cfg.LoggingLevel)
+}
+
+func TestLoadServerReportsEveryInvalidField(t *testing.T) {
+	path := writeConfigFile(t, "config.ini", "[DEFAULT]\nSERVER_PORT = 70000\nLOGGING_LEVEL = LOUD\n")
+
+	cfg, mode, err := LoadServer([]string{"--config", path, "--print-config"})
+	assert.NotNil(t, cfg)
+	assert.Equal(t, PrintMode, mode)
+	var validationErr ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Len(t, validationErr, 3)
+}
+
+func TestLoadServerFailsWhenExplicitConfigFileIsMissing(t *testing.T) {
+	cfg, _, err := LoadServer([]string{"--config", filepath.Join(t.TempDir(), "missing.ini")})
+	assert.Error(t, err)
+	assert.Nil(t, cfg)
+}
+
+func TestLoadClientReadsPrefixedEnv(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "server:\n  address: \"server:12345\"\nloop:\n  period: \"150ms\"\n")
+	t.Setenv("CLI_ID", "3")
+	t.Setenv("CLI_BATCH_MAXAMOUNT", "50")
+
+	cfg, mode, err := LoadClient([]string{"--config", path, "--check-config"})
+	assert.NoError(t, err)
+	assert.Equal(t, CheckMode, mode)
+	assert.Equal(t, 3, cfg.ID)
+	assert.Equal(t, "server:12345", cfg.ServerAddress)
+	assert.Equal(t, 50, cfg.BatchMaxAmount)
+	assert.Equal(t, "INFO", cfg.LogLevel)
+}
+
+func TestLoadClientRejectsOutOfRangeValues(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "server:\n  address: \"server:12345\"\n")
+
+	_, _, err := LoadClient([]string{"--config", path, "--id", "0", "--batch-max-amount", "0"})
+	var validationErr ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Len(t, validationErr, 2)
+}
+
+func TestLoadClientReadsAgenciesList(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "server:\n  address: \"server:12345\"\nagencies:\n  - 1=/data/agency-1.csv\n  - 2=/data/agency-2.csv\n")
+
+	cfg, _, err := LoadClient([]string{"--config", path})
+	assert.NoError(t, err)
+	assert.Equal(t, []Agency{{ID: 1, InputPath: "/data/agency-1.csv"}, {ID: 2, InputPath: "/data/agency-2.csv"}}, cfg.Agencies)
+
+	t.Setenv("CLI_AGENCIES", "3=/a.csv,3=/b.csv,x=/c.csv")
+	_, _, err = LoadClient([]string{"--config", path})
+	var validationErr ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Len(t, validationErr, 2)
+}
+
+func TestLoadClientTakesTheCommandFromTheArguments(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "server:\n  address: \"server:12345\"\nid: 1\n")
+
+	cfg, _, err := LoadClient([]string{"--config", path})
+	assert.NoError(t, err)
+	assert.Equal(t, "all", cfg.Command)
+
+	t.Setenv("CLI_COMMAND", "upload")
+	cfg, _, err = LoadClient([]string{"status", "--config", path})
+	assert.NoError(t, err)
+	assert.Equal(t, "status", cfg.Command)
+
+	_, _, err = LoadClient([]string{"--config", path, "draw"})
+	var validationErr ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+}
@@ -0,0 +1,217 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// maxChecksumRetries Frames in a row that may arrive corrupted before the
+// connection is given up
+const maxChecksumRetries = 3
+
+// retransmitHistory Frames written that are kept to be sent again if the
+// peer reports them corrupted
+const retransmitHistory = 64
+
+// Conn A connection that exchanges messages. Once checksums are enabled,
+// with EnableChecksum or because the peer sent a frame with one, every
+// frame written carries a CRC32C trailer. A corrupted frame is answered
+// with a ChecksumErrorMessage and the peer sends it again, which both ends
+// handle while reading, so callers only see the messages that arrived
+// intact. Compression is negotiated the same way: once enabled, with
+// EnableCompression or because the peer sent a compressed frame, batches
+// above the threshold are sent compressed. Heartbeats too: once started,
+// with StartHeartbeat or because the peer sent a Ping, the connection is
+// closed if nothing arrives for too long while reading. Reads must come
+// from a single goroutine, writes may come from any
+type Conn struct {
+	net.Conn
+	// read Frames read so far, the index of the next one
+	read uint64
+	// mismatches Frames read in a row with a wrong checksum
+	mismatches int
+	// maxDecompressed Largest payload a compressed frame may expand to
+	maxDecompressed int
+
+	writeMutex sync.Mutex
+	options    frameOptions
+	// written Frames written so far, the index of the next one
+	written uint64
+	// history Last frames written with a checksum, by index
+	history map[uint64][]byte
+
+	heartbeat heartbeat
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConn Returns a connection that exchanges messages on conn, without
+// checksums nor compression until they are enabled
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:            conn,
+		maxDecompressed: MaxPayloadLength,
+		history:         make(map[uint64][]byte),
+		closed:          make(chan struct{}),
+	}
+}
+
+// EnableChecksum Makes every frame written from now on carry a checksum
+// trailer. The peer answers with checksums too once it reads one
+func (c *Conn) EnableChecksum() {
+	c.writeMutex.Lock()
+	c.options.checksum = true
+	c.writeMutex.Unlock()
+}
+
+// EnableCompression Makes the batches written from now on be compressed if
+// their payload has at least threshold bytes. The peer compresses its own
+// batches too once it reads a compressed frame
+func (c *Conn) EnableCompression(threshold int) {
+	c.writeMutex.Lock()
+	c.options.compress = true
+	c.options.compressThreshold = threshold
+	c.writeMutex.Unlock()
+}
+
+// SetMaxDecompressedLength Makes the compressed frames that expand beyond
+// limit bytes fail with ErrDecompressedTooLarge. Must be called before
+// reading
+func (c *Conn) SetMaxDecompressedLength(limit int) {
+	c.maxDecompressed = limit
+}
+
+// ReadMessage Same as ReadMessageContext, without a context
+func (c *Conn) ReadMessage() (Message, error) {
+	return c.ReadMessageContext(context.Background())
+}
+
+// ReadMessageContext Reads the next message that arrives intact. Corrupted
+// frames are reported to the peer, which sends them again, and frames the
+// peer reports corrupted are sent again, until maxChecksumRetries frames in
+// a row fail. Pings are answered and, like pongs, not returned. The read
+// fails once ctx is done or its deadline passes, or with
+// ErrPeerUnresponsive if the heartbeat gave the peer up
+func (c *Conn) ReadMessageContext(ctx context.Context) (Message, error) {
+	c.heartbeat.readStarted()
+	defer c.heartbeat.readFinished()
+	for {
+		raw, err := readRawMessageContext(ctx, c.Conn, c.maxDecompressed)
+		if err != nil && c.heartbeat.gaveUp() {
+			return nil, fmt.Errorf("%w: nothing read for %v", ErrPeerUnresponsive, c.heartbeat.timeout())
+		}
+		c.heartbeat.frameRead()
+		var mismatch *ChecksumMismatchError
+		var malformed *MalformedMessageError
+		if errors.As(err, &malformed) {
+			// The frame was read whole, the next one keeps its index
+			c.read++
+			c.mismatches = 0
+			return nil, err
+		}
+		if err != nil && !errors.As(err, &mismatch) {
+			return nil, err
+		}
+		frame := c.read
+		c.read++
+
+		if mismatch != nil {
+			c.mismatches++
+			if c.mismatches > maxChecksumRetries {
+				return nil, err
+			}
+			if _, err := c.WriteMessageContext(ctx, &ChecksumErrorMessage{Frame: frame}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		c.mismatches = 0
+		if raw.Checksum {
+			c.EnableChecksum()
+		}
+		if raw.Compressed {
+			c.mirrorCompression()
+		}
+
+		message, err := raw.Decode()
+		if err != nil {
+			return nil, err
+		}
+		switch message := message.(type) {
+		case *ChecksumErrorMessage:
+			err = c.retransmit(ctx, message.Frame)
+		case *PingMessage:
+			c.StartHeartbeat()
+			_, err = c.WriteMessageContext(ctx, &PongMessage{Sequence: message.Sequence})
+		case *PongMessage:
+		default:
+			return message, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close Closes the connection and stops its heartbeat
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// WriteMessage Same as WriteMessageContext, without a context
+func (c *Conn) WriteMessage(message Message) (int, error) {
+	return c.WriteMessageContext(context.Background(), message)
+}
+
+// WriteMessageContext Writes the message, with a checksum trailer if they
+// are enabled, and returns the size of the frame. The write fails once ctx
+// is done or its deadline passes
+func (c *Conn) WriteMessageContext(ctx context.Context, message Message) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	frame, err := encodeFrame(message, c.options)
+	if err != nil {
+		return 0, err
+	}
+	return len(frame), c.writeFrameLocked(ctx, frame)
+}
+
+// mirrorCompression Enables compression with the default threshold, unless
+// it already was enabled with another one
+func (c *Conn) mirrorCompression() {
+	c.writeMutex.Lock()
+	if !c.options.compress {
+		c.options.compress = true
+		c.options.compressThreshold = DefaultCompressionThreshold
+	}
+	c.writeMutex.Unlock()
+}
+
+// retransmit Writes again the frame with the given index
+func (c *Conn) retransmit(ctx context.Context, index uint64) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	frame, ok := c.history[index]
+	if !ok {
+		return fmt.Errorf("error retransmitting frame %v: no longer kept", index)
+	}
+	return c.writeFrameLocked(ctx, frame)
+}
+
+// writeFrameLocked Writes an encoded frame and keeps it in the history if
+// it has a checksum. Must be called with writeMutex held
+func (c *Conn) writeFrameLocked(ctx context.Context, frame []byte) error {
+	if err := WriteSafeContext(ctx, c.Conn, frame); err != nil {
+		return err
+	}
+	if c.options.checksum {
+		c.history[c.written] = frame
+		delete(c.history, c.written-retransmitHistory)
+	}
+	c.written++
+	return nil
+}
@@ -0,0 +1,274 @@
+package shared
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/bets"
+	"github.com/stretchr/testify/assert"
+)
+
+// faultyConn Flips a bit of the byte at each of the given offsets of the
+// stream written to the connection
+type faultyConn struct {
+	net.Conn
+	flips   map[int]bool
+	written int
+}
+
+func (c *faultyConn) Write(p []byte) (int, error) {
+	corrupted := append([]byte{}, p...)
+	for i := range corrupted {
+		if c.flips[c.written+i] {
+			corrupted[i] ^= 0x10
+		}
+	}
+	n, err := c.Conn.Write(corrupted)
+	c.written += n
+	return n, err
+}
+
+// newFaultyPair Returns both ends of a TCP connection. What the first one
+// writes is corrupted at the given offsets
+func newFaultyPair(t *testing.T, flips ...int) (*Conn, *Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	faulty := &faultyConn{Conn: client, flips: make(map[int]bool)}
+	for _, offset := range flips {
+		faulty.flips[offset] = true
+	}
+	return NewConn(faulty), NewConn(server)
+}
+
+func testBet(t *testing.T) *BetMessage {
+	bet, err := bets.NewBet("3", "Juan", "Perez", "30904465", "1999-03-17", 7574)
+	assert.NoError(t, err)
+	return &BetMessage{ReceivedBet: *bet}
+}
+
+func TestCorruptionGoesUnnoticedWithoutChecksum(t *testing.T) {
+	client, server := newFaultyPair(t, HeaderLength+15)
+	defer client.Close()
+	defer server.Close()
+
+	go client.WriteMessage(testBet(t))
+	message, err := server.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "30)04465", message.(*BetMessage).ReceivedBet.Document)
+}
+
+func TestCorruptedFrameIsSentAgain(t *testing.T) {
+	// Flips a digit of the document in the payload
+	client, server := newFaultyPair(t, HeaderLength+15)
+	defer client.Close()
+	defer server.Close()
+	client.EnableChecksum()
+	sent := testBet(t)
+
+	go func() {
+		client.WriteMessage(sent)
+		// Reading the response handles the checksum error sent back
+		client.ReadMessage()
+	}()
+
+	message, err := server.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, sent, message)
+	_, err = server.WriteMessage(&BetResponse{Success: true})
+	assert.NoError(t, err)
+}
+
+func TestCorruptedFramesInAPipelineAreSentAgain(t *testing.T) {
+	batches := []*NumberedBatchMessage{
+		{Agency: 3, Session: 1, BatchID: 1, ReceivedBets: [][]string{{"3", "Juan", "Perez", "30904465", "1999-03-17", "7574"}}},
+		{Agency: 3, Session: 1, BatchID: 2, ReceivedBets: [][]string{{"3", "Ana", "Gomez", "30904466", "1999-03-17", "10"}}},
+		{Agency: 3, Session: 1, BatchID: 3, ReceivedBets: [][]string{{"3", "Luis", "Diaz", "30904467", "1999-03-17", "11"}}},
+	}
+	frame, _ := encodeFrame(batches[0], frameOptions{checksum: true})
+	// Flips the type of the first frame and a bet of the second one, both
+	// are sent again after the third one
+	client, server := newFaultyPair(t, 3, len(frame)+HeaderLength+NumberedBatchHeaderLength+2)
+	defer client.Close()
+	defer server.Close()
+	client.EnableChecksum()
+
+	go func() {
+		for _, batch := range batches {
+			client.WriteMessage(batch)
+		}
+		client.ReadMessage()
+	}()
+
+	received := make(map[int64]*NumberedBatchMessage)
+	for len(received) < len(batches) {
+		message, err := server.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		batch := message.(*NumberedBatchMessage)
+		received[batch.BatchID] = batch
+	}
+	for _, batch := range batches {
+		assert.Equal(t, batch, received[batch.BatchID])
+	}
+	server.WriteMessage(&BatchAckMessage{BatchID: 3})
+}
+
+func TestRepliesCarryChecksumsOnceThePeerSendsThem(t *testing.T) {
+	client, server := newFaultyPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.EnableChecksum()
+
+	go client.WriteMessage(&StatusQueryMessage{Agency: 3})
+	_, err := server.ReadMessage()
+	assert.NoError(t, err)
+
+	raw := make(chan *RawMessage)
+	go func() {
+		message, _ := readRawMessage(client.Conn, MaxPayloadLength)
+		raw <- message
+	}()
+	server.WriteMessage(&StatusMessage{})
+	assert.True(t, (<-raw).Checksum)
+}
+
+func TestConnectionFailsWhenFramesKeepArrivingCorrupted(t *testing.T) {
+	// Every copy of the query the client sends is corrupted
+	frame, _ := encodeFrame(&StatusQueryMessage{}, frameOptions{checksum: true})
+	var flips []int
+	for i := 0; i <= maxChecksumRetries; i++ {
+		flips = append(flips, i*len(frame)+HeaderLength)
+	}
+	client, server := newFaultyPair(t, flips...)
+	defer client.Close()
+	defer server.Close()
+	client.EnableChecksum()
+
+	go func() {
+		client.WriteMessage(&StatusQueryMessage{Agency: 3})
+		for {
+			if _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan error)
+	go func() {
+		_, err := server.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var mismatch *ChecksumMismatchError
+		assert.ErrorAs(t, err, &mismatch)
+	case <-time.After(time.Second):
+		t.Fatal("the connection kept retrying")
+	}
+}
+
+func testBatch(bets int) *NumberedBatchMessage {
+	batch := &NumberedBatchMessage{Agency: 3, Session: 1, BatchID: 1}
+	for i := 0; i < bets; i++ {
+		batch.ReceivedBets = append(batch.ReceivedBets, []string{"3", "Juan", "Perez", "30904465", "1999-03-17", "7574"})
+	}
+	return batch
+}
+
+func TestLargeBatchesAreSentCompressed(t *testing.T) {
+	client, server := newFaultyPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.EnableCompression(DefaultCompressionThreshold)
+	large := testBatch(100)
+	small := testBatch(1)
+
+	go func() {
+		client.WriteMessage(large)
+		client.WriteMessage(small)
+	}()
+	raw, err := readRawMessage(server.Conn, MaxPayloadLength)
+	assert.NoError(t, err)
+	assert.True(t, raw.Compressed)
+	assert.Less(t, raw.Length, len(raw.Payload))
+	message, err := raw.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, large, message)
+
+	raw, err = readRawMessage(server.Conn, MaxPayloadLength)
+	assert.NoError(t, err)
+	assert.False(t, raw.Compressed)
+}
+
+func TestCompressedPayloadAboveTheLimitIsRejected(t *testing.T) {
+	client, server := newFaultyPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.EnableCompression(0)
+	server.SetMaxDecompressedLength(1024)
+
+	go client.WriteMessage(testBatch(1000))
+	_, err := server.ReadMessage()
+	assert.ErrorIs(t, err, ErrDecompressedTooLarge)
+}
+
+func TestPingsAreAnsweredWithoutReachingTheCaller(t *testing.T) {
+	client, server := newFaultyPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.SetHeartbeat(10*time.Millisecond, 3)
+	client.StartHeartbeat()
+	server.SetHeartbeat(10*time.Millisecond, 3)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.WriteMessage(&StatusQueryMessage{Agency: 3})
+	}()
+	message, err := server.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, &StatusQueryMessage{Agency: 3}, message)
+
+	// The server answers with its own pings, which keep the client waiting
+	// for a slow reply
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.WriteMessage(&StatusMessage{})
+	}()
+	message, err = client.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, &StatusMessage{}, message)
+}
+
+func TestSilentPeerIsGivenUp(t *testing.T) {
+	client, server := newFaultyPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.SetHeartbeat(10*time.Millisecond, 3)
+	client.StartHeartbeat()
+
+	// The server never reads, so it never answers the pings
+	done := make(chan error)
+	go func() {
+		_, err := client.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrPeerUnresponsive)
+	case <-time.After(time.Second):
+		t.Fatal("the silent peer was not given up")
+	}
+}
@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPeerUnresponsive Nothing arrived from the peer for as many heartbeat
+// intervals as the connection tolerates, so it was closed
+var ErrPeerUnresponsive = errors.New("peer unresponsive")
+
+// heartbeat Sends a Ping every interval and gives the peer up if nothing
+// is read from it for misses intervals. Only the time spent reading
+// counts: while nobody reads, the frames the peer sends wait unread and
+// can't prove it is alive
+type heartbeat struct {
+	interval time.Duration
+	misses   int
+	once     sync.Once
+
+	// lastRead Unix nanoseconds of the last frame read, or of the start of
+	// the current read if it is later
+	lastRead int64
+	reading  int32
+	givenUp  int32
+	// pinging Whether a Ping is still being written, so a blocked write
+	// doesn't pile up more
+	pinging int32
+}
+
+// SetHeartbeat Configures the heartbeat of the connection: a Ping every
+// interval, and the connection is closed after misses intervals without
+// reading anything. An interval of 0 disables it. Must be called before
+// reading
+func (c *Conn) SetHeartbeat(interval time.Duration, misses int) {
+	c.heartbeat.interval = interval
+	c.heartbeat.misses = misses
+}
+
+// StartHeartbeat Starts the heartbeat configured with SetHeartbeat, if it
+// is not running yet. The peer starts its own once it reads a Ping
+func (c *Conn) StartHeartbeat() {
+	if c.heartbeat.interval <= 0 {
+		return
+	}
+	c.heartbeat.once.Do(func() { go c.beat() })
+}
+
+// beat Sends the Pings and closes the connection once the peer is given
+// up, until the connection is closed
+func (c *Conn) beat() {
+	ticker := time.NewTicker(c.heartbeat.interval)
+	defer ticker.Stop()
+	var sequence uint64
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+		if c.heartbeat.missed() {
+			atomic.StoreInt32(&c.heartbeat.givenUp, 1)
+			c.Close()
+			return
+		}
+		if !atomic.CompareAndSwapInt32(&c.heartbeat.pinging, 0, 1) {
+			continue
+		}
+		sequence++
+		go func(sequence uint64) {
+			// A write can't be abandoned halfway without breaking the
+			// stream, a blocked one ends when the connection is closed
+			c.WriteMessageContext(context.Background(), &PingMessage{Sequence: sequence})
+			atomic.StoreInt32(&c.heartbeat.pinging, 0)
+		}(sequence)
+	}
+}
+
+// timeout Time without reading anything after which the peer is given up
+func (h *heartbeat) timeout() time.Duration {
+	return h.interval * time.Duration(h.misses)
+}
+
+func (h *heartbeat) readStarted() {
+	h.frameRead()
+	atomic.StoreInt32(&h.reading, 1)
+}
+
+func (h *heartbeat) readFinished() {
+	atomic.StoreInt32(&h.reading, 0)
+}
+
+func (h *heartbeat) frameRead() {
+	atomic.StoreInt64(&h.lastRead, time.Now().UnixNano())
+}
+
+// missed Whether a read has been waiting for longer than the timeout
+// without any frame arriving
+func (h *heartbeat) missed() bool {
+	if atomic.LoadInt32(&h.reading) == 0 {
+		return false
+	}
+	lastRead := time.Unix(0, atomic.LoadInt64(&h.lastRead))
+	return time.Since(lastRead) > h.timeout()
+}
+
+func (h *heartbeat) gaveUp() bool {
+	return atomic.LoadInt32(&h.givenUp) == 1
+}
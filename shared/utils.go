@@ -1,17 +1,23 @@
 package shared
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"net"
+	"time"
 )
 
-func WriteSafe(conn net.Conn, message []byte) error {
-	written, err := conn.Write(message)
+// WriteSafe Writes the whole message to w, even if it takes several writes
+func WriteSafe(w io.Writer, message []byte) error {
+	written, err := w.Write(message)
 	if err != nil {
 		return err
 	}
 
 	for written < len(message) {
-		tmp, err := conn.Write(message[written:])
+		tmp, err := w.Write(message[written:])
 		if err != nil {
 			return err
 		}
@@ -19,3 +25,77 @@ func WriteSafe(conn net.Conn, message []byte) error {
 	}
 	return nil
 }
+
+// WriteSafeContext Same as WriteSafe, but the write fails once ctx is done
+// or its deadline passes. The error is then the one of ctx
+func WriteSafeContext(ctx context.Context, conn net.Conn, message []byte) error {
+	stop := watchContext(ctx, conn.SetWriteDeadline)
+	err := WriteSafe(conn, message)
+	stop()
+	return contextError(ctx, err)
+}
+
+// MessageFromSocketContext Same as MessageFromSocket, but the read fails
+// once ctx is done or its deadline passes. The error is then the one of ctx
+func MessageFromSocketContext(ctx context.Context, conn net.Conn) (*RawMessage, error) {
+	return readRawMessageContext(ctx, conn, MaxPayloadLength)
+}
+
+// readRawMessageContext Same as readRawMessage, but the read fails once ctx
+// is done or its deadline passes
+func readRawMessageContext(ctx context.Context, conn net.Conn, maxDecompressed int) (*RawMessage, error) {
+	stop := watchContext(ctx, conn.SetReadDeadline)
+	message, err := readRawMessage(conn, maxDecompressed)
+	stop()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return message, nil
+}
+
+// expiredDeadline A deadline in the past, makes blocked reads and writes
+// return at once
+var expiredDeadline = time.Unix(1, 0)
+
+// watchContext Applies the deadline of ctx, if it has one, with
+// setDeadline and moves it to the past once ctx is done. The returned
+// function stops watching ctx and clears the deadline. A context that can't
+// be canceled is not watched at all
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		setDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(expiredDeadline)
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		setDeadline(time.Time{})
+	}
+}
+
+// contextError Returns the error of ctx instead of err if ctx is done, so
+// callers can tell a canceled operation from a failed one
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Digest Hex encoded SHA-256 of data
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}